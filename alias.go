@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"formalshell/cmds"
+	"formalshell/expand"
+	"formalshell/parser"
+	"formalshell/shell"
+)
+
+var (
+	// savedAliases holds the aliases defined at the prompt, which are kept
+	// in the aliases file across sessions.
+	savedAliases = make(map[string]string)
+	// persistAliases is set once startup has finished, so that aliases
+	// defined from then on are saved.
+	persistAliases bool
+)
+
+// aliasFile returns the path of the file saved aliases are kept in.
+func aliasFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "formalshell", "aliases"), nil
+}
+
+// lookupAlias returns the text of an alias for the parser. A function of
+// the same name hides the alias, as functions are looked up first.
+func (sh *shellState) lookupAlias(name string) (string, bool) {
+	if _, ok := sh.functions[name]; ok {
+		return "", false
+	}
+	value, ok := aliases[name]
+	return value, ok
+}
+
+// aliasBuiltin implements `alias [-p] [name[=value] ...]`. Without
+// arguments it lists every alias in a form that can be read back in.
+func aliasBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if len(args) > 0 && args[0] == "-p" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		names := make([]string, 0, len(aliases))
+		for name := range aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(stdio.Stdout, "alias %s=%s\n", name, shell.Quote(aliases[name]))
+		}
+		return 0
+	}
+
+	status := 0
+	changed := false
+	for _, arg := range args {
+		name, value, isDef := strings.Cut(arg, "=")
+		if !isDef {
+			if value, ok := aliases[name]; ok {
+				fmt.Fprintf(stdio.Stdout, "alias %s=%s\n", name, shell.Quote(value))
+			} else {
+				fmt.Fprintf(stdio.Stderr, "alias: %s: not found\n", name)
+				status = 1
+			}
+			continue
+		}
+		if !validAliasName(name) {
+			fmt.Fprintf(stdio.Stderr, "alias: %s: invalid alias name\n", name)
+			status = 1
+			continue
+		}
+		aliases[name] = value
+		if persistAliases {
+			savedAliases[name] = value
+			changed = true
+		}
+	}
+	if changed {
+		saveAliases(stdio)
+	}
+	return status
+}
+
+// unaliasBuiltin implements `unalias [-a] name ...`.
+func unaliasBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if len(args) > 0 && args[0] == "-a" {
+		clear(aliases)
+		if persistAliases && len(savedAliases) > 0 {
+			clear(savedAliases)
+			saveAliases(stdio)
+		}
+		return 0
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(stdio.Stderr, "unalias: usage: unalias [-a] name ...")
+		return 2
+	}
+
+	status := 0
+	changed := false
+	for _, name := range args {
+		if _, ok := aliases[name]; !ok {
+			fmt.Fprintf(stdio.Stderr, "unalias: %s: not found\n", name)
+			status = 1
+			continue
+		}
+		delete(aliases, name)
+		if _, ok := savedAliases[name]; ok && persistAliases {
+			delete(savedAliases, name)
+			changed = true
+		}
+	}
+	if changed {
+		saveAliases(stdio)
+	}
+	return status
+}
+
+// validAliasName reports whether name can be used as an alias. It may not
+// contain blanks, quotes, expansions or operators, since it has to be read
+// back as a single plain word.
+func validAliasName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\n/$`'\"\\=;&|()<>")
+}
+
+// saveAliases writes the saved aliases to the aliases file as alias
+// commands.
+func saveAliases(stdio *cmds.IO) {
+	path, err := aliasFile()
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "alias: %v\n", err)
+		return
+	}
+
+	names := make([]string, 0, len(savedAliases))
+	for name := range savedAliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "alias %s=%s\n", name, shell.Quote(savedAliases[name]))
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+		err = os.WriteFile(path, []byte(sb.String()), 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "alias: saving aliases: %v\n", err)
+	}
+}
+
+// loadAliases runs the alias commands found at the top level of the file
+// at path, ignoring everything else. A missing file is not an error.
+func loadAliases(sh *shellState, path string, saved bool) error {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	list, err := parser.Parse(string(src))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	stdio := cmds.StdIO()
+	for _, andOr := range list.Items {
+		for _, pipeline := range andOr.Pipelines {
+			for _, cmd := range pipeline.Cmds {
+				simple, ok := cmd.(*parser.SimpleCommand)
+				if !ok || len(simple.Args) == 0 || simple.Args[0].Lit() != "alias" {
+					continue
+				}
+				args, err := expand.Fields(shellEnv{sh: sh}, simple.Args[1:]...)
+				if err != nil {
+					return fmt.Errorf("%s: %w", path, err)
+				}
+				aliasBuiltin(sh, stdio, args)
+				if saved {
+					for _, arg := range args {
+						if name, value, ok := strings.Cut(arg, "="); ok && validAliasName(name) {
+							savedAliases[name] = value
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
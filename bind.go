@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"formalshell/cmds"
+	"github.com/chzyer/readline"
+)
+
+// editActions maps readline command names to the key readline handles
+// them with. A bound key is translated to that key before readline sees it.
+var editActions = map[string]rune{
+	"beginning-of-line":      readline.CharLineStart,
+	"end-of-line":            readline.CharLineEnd,
+	"backward-char":          readline.CharBackward,
+	"forward-char":           readline.CharForward,
+	"backward-word":          readline.MetaBackward,
+	"forward-word":           readline.MetaForward,
+	"kill-word":              readline.MetaDelete,
+	"backward-kill-word":     readline.MetaBackspace,
+	"unix-word-rubout":       readline.CharCtrlW,
+	"delete-char":            readline.CharDelete,
+	"backward-delete-char":   readline.CharBackspace,
+	"kill-line":              readline.CharKill,
+	"unix-line-discard":      readline.CharCtrlU,
+	"yank":                   readline.CharCtrlY,
+	"transpose-chars":        readline.CharTranspose,
+	"clear-screen":           readline.CharCtrlL,
+	"accept-line":            readline.CharEnter,
+	"previous-history":       readline.CharPrev,
+	"next-history":           readline.CharNext,
+	"reverse-search-history": readline.CharBckSearch,
+	"forward-search-history": readline.CharFwdSearch,
+	"complete":               readline.CharTab,
+	"abort":                  readline.CharBell,
+}
+
+// keyBindings maps keys to the names of the edit actions bound to them
+// with the bind builtin.
+var keyBindings = make(map[rune]string)
+
+// metaKeys are the Alt combinations readline reports as keys of their own.
+var metaKeys = map[rune]rune{
+	'b': readline.MetaBackward,
+	'f': readline.MetaForward,
+	'd': readline.MetaDelete,
+}
+
+// bindBuiltin implements `bind KEY ACTION`, also written in readline's
+// form as `bind '"KEY": ACTION'`. `bind -l` lists the actions, `bind -p`
+// lists the bindings and `bind -r KEY` removes one. Keys are written as
+// \C-x for Ctrl, \M-x or \ex for Alt, or as a single character.
+func bindBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stdio.Stderr, "bind: usage: bind [-lp] [-r KEY] [KEY ACTION]")
+		return 2
+	}
+
+	switch args[0] {
+	case "-l":
+		names := make([]string, 0, len(editActions))
+		for name := range editActions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintln(stdio.Stdout, name)
+		}
+		return 0
+	case "-p":
+		keys := make([]rune, 0, len(keyBindings))
+		for key := range keyBindings {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		for _, key := range keys {
+			fmt.Fprintf(stdio.Stdout, "\"%s\": %s\n", formatKey(key), keyBindings[key])
+		}
+		return 0
+	case "-r":
+		status := 0
+		for _, spec := range args[1:] {
+			key, err := parseKey(spec)
+			if err != nil {
+				fmt.Fprintf(stdio.Stderr, "bind: %v\n", err)
+				status = 1
+				continue
+			}
+			delete(keyBindings, key)
+		}
+		return status
+	}
+
+	spec, action := args[0], ""
+	if len(args) == 1 {
+		// Readline's own syntax: "\C-a": beginning-of-line
+		quoted, rest, ok := strings.Cut(args[0], ":")
+		if !ok {
+			fmt.Fprintf(stdio.Stderr, "bind: %s: missing action\n", args[0])
+			return 1
+		}
+		spec, action = strings.Trim(quoted, `"`), strings.TrimSpace(rest)
+	} else {
+		action = args[1]
+	}
+
+	key, err := parseKey(spec)
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "bind: %v\n", err)
+		return 1
+	}
+	if _, ok := editActions[action]; !ok {
+		fmt.Fprintf(stdio.Stderr, "bind: %s: unknown action\n", action)
+		return 1
+	}
+	keyBindings[key] = action
+	return 0
+}
+
+// parseKey reads a key written as \C-x, \M-x, \ex or a single character.
+func parseKey(spec string) (rune, error) {
+	rest, meta := strings.CutPrefix(spec, `\M-`)
+	if !meta {
+		rest, meta = strings.CutPrefix(spec, `\e`)
+	}
+	if meta {
+		runes := []rune(rest)
+		if len(runes) == 1 {
+			if key, ok := metaKeys[runes[0]]; ok {
+				return key, nil
+			}
+		}
+		return 0, fmt.Errorf("%s: only \\M-b, \\M-f and \\M-d can be bound", spec)
+	}
+
+	if rest, ok := strings.CutPrefix(spec, `\C-`); ok {
+		runes := []rune(strings.ToLower(rest))
+		if len(runes) != 1 || runes[0] < 'a' || runes[0] > 'z' {
+			return 0, fmt.Errorf("%s: invalid key", spec)
+		}
+		return runes[0] - 'a' + 1, nil
+	}
+
+	runes := []rune(spec)
+	if len(runes) != 1 {
+		return 0, fmt.Errorf("%s: invalid key", spec)
+	}
+	return runes[0], nil
+}
+
+// formatKey writes a key the way parseKey reads it.
+func formatKey(key rune) string {
+	for r, meta := range metaKeys {
+		if meta == key {
+			return `\M-` + string(r)
+		}
+	}
+	if key >= 1 && key <= 26 {
+		return `\C-` + string('a'+key-1)
+	}
+	return string(key)
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"formalshell/cmds"
+	"formalshell/jobs"
+	"formalshell/parser"
+	"formalshell/shell"
+)
+
+// builtinFunc implements a builtin command, run in the shell state sh, and
+// returns its exit status.
+type builtinFunc func(sh *shellState, stdio *cmds.IO, args []string) int
+
+// builtins maps command names to their Go implementations. Builtins are
+// checked after functions and before external commands.
+var builtins map[string]builtinFunc
+
+func init() {
+	builtins = map[string]builtinFunc{
+		"exit": exitShell,
+		"cd": func(sh *shellState, stdio *cmds.IO, args []string) int {
+			return cmds.HandleCD(stdio, args)
+		},
+		"ls": func(sh *shellState, stdio *cmds.IO, args []string) int {
+			return cmds.CustomLS(stdio, args...)
+		},
+		"jobs":   jobsBuiltin,
+		"fg":     fgBuiltin,
+		"bg":     bgBuiltin,
+		"wait":   waitBuiltin,
+		"disown": disownBuiltin,
+		"export": exportBuiltin,
+		"unset":  unsetBuiltin,
+		"set":    setBuiltin,
+		"shift":  shiftBuiltin,
+		"break": func(sh *shellState, stdio *cmds.IO, args []string) int {
+			return loopJump(sh, stdio, "break", jumpBreak, args)
+		},
+		"continue": func(sh *shellState, stdio *cmds.IO, args []string) int {
+			return loopJump(sh, stdio, "continue", jumpContinue, args)
+		},
+		"return":        returnBuiltin,
+		"local":         localBuiltin,
+		"alias":         aliasBuiltin,
+		"unalias":       unaliasBuiltin,
+		"source":        sourceBuiltin,
+		".":             sourceBuiltin,
+		"reload-config": reloadConfigBuiltin,
+		"bind":          bindBuiltin,
+		"history":       historyBuiltin,
+		"complete":      completeBuiltin,
+		"compgen":       compgenBuiltin,
+		"bashcomp":      bashcompBuiltin,
+		":": func(sh *shellState, stdio *cmds.IO, args []string) int {
+			return 0
+		},
+	}
+}
+
+// builtinHelp holds a one-line description of each builtin, shown beside
+// its name when completing commands.
+var builtinHelp = map[string]string{
+	"exit":          "exit the shell",
+	"cd":            "change the working directory",
+	"ls":            "list files with colors and icons",
+	"jobs":          "list background jobs",
+	"fg":            "bring a job to the foreground",
+	"bg":            "resume a stopped job in the background",
+	"wait":          "wait for jobs to finish",
+	"disown":        "forget about a job",
+	"export":        "export variables to commands",
+	"unset":         "remove variables",
+	"set":           "set options or positional parameters",
+	"shift":         "shift the positional parameters",
+	"break":         "leave a loop",
+	"continue":      "start the next loop iteration",
+	"return":        "return from a function or sourced script",
+	"local":         "declare function-local variables",
+	"alias":         "define or list aliases",
+	"unalias":       "remove aliases",
+	"source":        "run a script in the current shell",
+	".":             "run a script in the current shell",
+	"reload-config": "run the config again",
+	"bind":          "bind keys to editing actions",
+	"history":       "list, search or edit the history",
+	"complete":      "define completions for commands",
+	"compgen":       "print the completions of a word",
+	"bashcomp":      "load bash completion scripts",
+	":":             "do nothing, successfully",
+}
+
+// exitShell implements the `exit [N]` builtin. Without an argument the
+// shell exits with the status of the last command. In a command
+// substitution or background list only that ends.
+func exitShell(sh *shellState, stdio *cmds.IO, args []string) int {
+	status := sh.lastStatus
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "exit: %s: numeric argument required\n", args[0])
+			return 2
+		}
+		status = n & 0xff
+	}
+	if sh.inSubshell {
+		sh.pending.kind, sh.pending.status = jumpExit, status
+		return status
+	}
+	if interactive {
+		fmt.Fprintln(stdio.Stdout, "Goodbye!")
+	}
+	os.Exit(status)
+	return status
+}
+
+// jobsBuiltin implements `jobs [-l] [-p]`.
+func jobsBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	long, pidsOnly := false, false
+	for _, arg := range args {
+		switch arg {
+		case "-l":
+			long = true
+		case "-p":
+			pidsOnly = true
+		default:
+			fmt.Fprintf(stdio.Stderr, "jobs: %s: invalid option\n", arg)
+			return 2
+		}
+	}
+
+	if pidsOnly {
+		for _, job := range jobs.All() {
+			fmt.Fprintln(stdio.Stdout, job.Pid())
+		}
+		return 0
+	}
+	jobs.List(stdio.Stdout, long)
+	return 0
+}
+
+// fgBuiltin implements `fg [%job]`, continuing a job in the foreground.
+func fgBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if !jobs.Enabled {
+		fmt.Fprintln(stdio.Stderr, "fg: no job control")
+		return 1
+	}
+
+	spec := ""
+	if len(args) > 0 {
+		spec = args[0]
+	}
+	job, err := jobs.Find(spec)
+	if err != nil {
+		fmt.Fprintln(stdio.Stderr, "fg:", err)
+		return 1
+	}
+
+	fmt.Fprintln(stdio.Stdout, job.Text)
+	return jobs.Resume(job, true)
+}
+
+// bgBuiltin implements `bg [%job ...]`, continuing stopped jobs in the
+// background.
+func bgBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if !jobs.Enabled {
+		fmt.Fprintln(stdio.Stderr, "bg: no job control")
+		return 1
+	}
+
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	status := 0
+	for _, spec := range args {
+		job, err := jobs.Find(spec)
+		if err != nil {
+			fmt.Fprintln(stdio.Stderr, "bg:", err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(stdio.Stdout, "[%d] %s &\n", job.ID, job.Text)
+		jobs.Resume(job, false)
+	}
+	return status
+}
+
+// waitBuiltin implements `wait [%job | pid ...]`. Without arguments it
+// waits for every background job.
+func waitBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if len(args) == 0 {
+		status := 0
+		for _, job := range jobs.All() {
+			if status = jobs.WaitFor(job); status == 130 {
+				break
+			}
+		}
+		return status
+	}
+
+	status := 0
+	for _, spec := range args {
+		job, err := findJob(spec)
+		if err != nil {
+			fmt.Fprintln(stdio.Stderr, "wait:", err)
+			status = 127
+			continue
+		}
+		status = jobs.WaitFor(job)
+	}
+	return status
+}
+
+// disownBuiltin implements `disown [-a] [%job ...]`.
+func disownBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if len(args) == 1 && args[0] == "-a" {
+		for _, job := range jobs.All() {
+			jobs.Disown(job)
+		}
+		return 0
+	}
+
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	status := 0
+	for _, spec := range args {
+		job, err := findJob(spec)
+		if err != nil {
+			fmt.Fprintln(stdio.Stderr, "disown:", err)
+			status = 1
+			continue
+		}
+		jobs.Disown(job)
+	}
+	return status
+}
+
+// findJob resolves a job spec, also accepting the process ID of a job.
+func findJob(spec string) (*jobs.Job, error) {
+	if !strings.HasPrefix(spec, "%") {
+		if pid, err := strconv.Atoi(spec); err == nil {
+			for _, job := range jobs.All() {
+				if job.Pid() == pid {
+					return job, nil
+				}
+			}
+			return nil, fmt.Errorf("pid %d is not a child of this shell", pid)
+		}
+	}
+	return jobs.Find(spec)
+}
+
+// exportBuiltin implements `export [-n] [-p] [NAME[=value] ...]`. Without
+// names it lists the exported variables.
+func exportBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	unexport := false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		opt := args[0]
+		args = args[1:]
+		if opt == "--" {
+			break
+		}
+		switch opt {
+		case "-n":
+			unexport = true
+		case "-p":
+		default:
+			fmt.Fprintf(stdio.Stderr, "export: %s: invalid option\n", opt)
+			return 2
+		}
+	}
+
+	if len(args) == 0 {
+		for _, name := range shellVars.Names() {
+			if v := shellVars.Lookup(name); v != nil && v.Exported {
+				fmt.Fprintf(stdio.Stdout, "export %s=%s\n", name, shell.Quote(v.Value))
+			}
+		}
+		return 0
+	}
+
+	status := 0
+	for _, arg := range args {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !parser.IsName(name) {
+			fmt.Fprintf(stdio.Stderr, "export: `%s': not a valid identifier\n", arg)
+			status = 1
+			continue
+		}
+		if hasValue {
+			shellVars.Set(name, value)
+		}
+		if unexport {
+			shellVars.Unexport(name)
+		} else {
+			shellVars.Export(name)
+		}
+	}
+	return status
+}
+
+// unsetBuiltin implements `unset [-v] NAME ...`.
+func unsetBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if len(args) > 0 && args[0] == "-v" {
+		args = args[1:]
+	}
+
+	status := 0
+	for _, name := range args {
+		if !parser.IsName(name) {
+			fmt.Fprintf(stdio.Stderr, "unset: `%s': not a valid identifier\n", name)
+			status = 1
+			continue
+		}
+		shellVars.Unset(name)
+	}
+	return status
+}
+
+// options holds the shell options set with `set -o NAME` and cleared with
+// `set +o NAME`.
+var options = map[string]bool{
+	"pipefail":     false,
+	"sharehistory": false,
+}
+
+// setBuiltin implements `set [-o NAME] [+o NAME] [--] [ARG ...]`. Without
+// arguments it lists every shell variable, and `set -o` alone lists the
+// options. Any other arguments replace the positional parameters.
+func setBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if len(args) == 0 {
+		for _, name := range shellVars.Names() {
+			value, _ := shellVars.Get(name)
+			fmt.Fprintf(stdio.Stdout, "%s=%s\n", name, shell.Quote(value))
+		}
+		return 0
+	}
+
+	for len(args) > 0 {
+		flag := args[0]
+		if flag == "--" {
+			sh.positional = append([]string(nil), args[1:]...)
+			return 0
+		}
+		if !strings.HasPrefix(flag, "-") && !strings.HasPrefix(flag, "+") {
+			sh.positional = append([]string(nil), args...)
+			return 0
+		}
+		if flag != "-o" && flag != "+o" {
+			fmt.Fprintf(stdio.Stderr, "set: %s: invalid option\n", flag)
+			return 2
+		}
+		if len(args) == 1 {
+			listOptions(stdio, flag == "+o")
+			return 0
+		}
+
+		name := args[1]
+		if _, ok := options[name]; !ok {
+			fmt.Fprintf(stdio.Stderr, "set: %s: invalid option name\n", name)
+			return 2
+		}
+		options[name] = flag == "-o"
+		args = args[2:]
+	}
+	return 0
+}
+
+// listOptions prints the shell options, either as a table or, with asSet,
+// as set commands that restore them.
+func listOptions(stdio *cmds.IO, asSet bool) {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		switch {
+		case asSet && options[name]:
+			fmt.Fprintf(stdio.Stdout, "set -o %s\n", name)
+		case asSet:
+			fmt.Fprintf(stdio.Stdout, "set +o %s\n", name)
+		case options[name]:
+			fmt.Fprintf(stdio.Stdout, "%-15s\ton\n", name)
+		default:
+			fmt.Fprintf(stdio.Stdout, "%-15s\toff\n", name)
+		}
+	}
+}
+
+// shiftBuiltin implements `shift [N]`, dropping the first N positional
+// parameters.
+func shiftBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	n := 1
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 0 {
+			fmt.Fprintf(stdio.Stderr, "shift: %s: numeric argument required\n", args[0])
+			return 2
+		}
+	}
+	if n > len(sh.positional) {
+		fmt.Fprintln(stdio.Stderr, "shift: shift count out of range")
+		return 1
+	}
+	sh.positional = sh.positional[n:]
+	return 0
+}
+
+// loopJump implements `break [N]` and `continue [N]`, leaving N enclosing
+// loops.
+func loopJump(sh *shellState, stdio *cmds.IO, name string, kind jumpKind, args []string) int {
+	if sh.loopDepth == 0 {
+		fmt.Fprintf(stdio.Stderr, "%s: only meaningful in a `for', `while', or `until' loop\n", name)
+		return 0
+	}
+
+	n := 1
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+			fmt.Fprintf(stdio.Stderr, "%s: %s: loop count out of range\n", name, args[0])
+			return 1
+		}
+	}
+	sh.pending.kind = kind
+	sh.pending.count = min(n, sh.loopDepth)
+	return 0
+}
+
+// returnBuiltin implements `return [N]`, leaving the current function or
+// sourced file with status N, or the status of the last command.
+func returnBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if len(sh.localFrames) == 0 && sh.sourceDepth == 0 {
+		fmt.Fprintln(stdio.Stderr, "return: can only `return' from a function or sourced script")
+		return 1
+	}
+
+	status := sh.lastStatus
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "return: %s: numeric argument required\n", args[0])
+			return 2
+		}
+		status = n & 0xff
+	}
+	sh.pending.kind = jumpReturn
+	return status
+}
+
+// localBuiltin implements `local NAME[=value] ...`, making variables local
+// to the current function. A local declared without a value starts unset.
+func localBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if len(sh.localFrames) == 0 {
+		fmt.Fprintln(stdio.Stderr, "local: can only be used in a function")
+		return 1
+	}
+
+	frame := sh.localFrames[len(sh.localFrames)-1]
+	status := 0
+	for _, arg := range args {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !parser.IsName(name) {
+			fmt.Fprintf(stdio.Stderr, "local: `%s': not a valid identifier\n", arg)
+			status = 1
+			continue
+		}
+
+		// Only the value from before the first declaration is restored
+		if _, saved := frame[name]; !saved {
+			frame[name] = shellVars.Lookup(name)
+		}
+		if hasValue {
+			shellVars.Set(name, value)
+		} else {
+			shellVars.Unset(name)
+		}
+	}
+	return status
+}
@@ -4,39 +4,30 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 )
 
 var dirDB = NewDirectoryDB()
 
-// HandleCD implements the 'cd' command to change directories.
-func HandleCD(args []string) {
+// HandleCD implements the 'cd' command to change directories and returns
+// its exit status.
+func HandleCD(stdio *IO, args []string) int {
 	if len(args) < 1 {
 		// Change to home directory if no args
 		homeDir, err := os.UserHomeDir()
 		if err != nil {
-			fmt.Println("cd:", err)
-			return
+			fmt.Fprintln(stdio.Stderr, "cd:", err)
+			return 1
 		}
 		if err := os.Chdir(homeDir); err != nil {
-			fmt.Println("cd:", err)
+			fmt.Fprintln(stdio.Stderr, "cd:", err)
+			return 1
 		}
 		dirDB.AddVisit(homeDir)
-		return
+		return 0
 	}
 
 	path := args[0]
 
-	// Handle home directory expansion
-	if strings.HasPrefix(path, "~/") {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			fmt.Println("cd:", err)
-			return
-		}
-		path = filepath.Join(homeDir, path[2:])
-	}
-
 	// Try smart directory matching if path doesn't exist
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		smartPath := dirDB.FindMatch(path)
@@ -48,16 +39,17 @@ func HandleCD(args []string) {
 	// Resolve relative paths
 	path, err := filepath.Abs(path)
 	if err != nil {
-		fmt.Println("cd:", err)
-		return
+		fmt.Fprintln(stdio.Stderr, "cd:", err)
+		return 1
 	}
 
 	// Change directory
 	if err := os.Chdir(path); err != nil {
-		fmt.Println("cd:", err)
-		return
+		fmt.Fprintln(stdio.Stderr, "cd:", err)
+		return 1
 	}
 
 	// Record successful directory change
 	dirDB.AddVisit(path)
+	return 0
 }
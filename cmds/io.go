@@ -0,0 +1,19 @@
+package cmds
+
+import (
+	"io"
+	"os"
+)
+
+// IO holds the streams a builtin reads from and writes to, so that its
+// output can be redirected or piped like an external command's.
+type IO struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// StdIO returns an IO connected to the shell's own standard streams.
+func StdIO() *IO {
+	return &IO{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+}
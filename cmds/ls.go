@@ -17,8 +17,8 @@ type fileInfo struct {
 	color       string
 }
 
-// formatSize converts size in bytes to human readable format
-func formatSize(size int64) string {
+// FormatSize converts size in bytes to human readable format
+func FormatSize(size int64) string {
 	const unit = 1024
 	if size < unit {
 		return fmt.Sprintf("%d B", size)
@@ -42,6 +42,20 @@ const (
 	gray    = "\033[38;5;242m" // Table borders
 )
 
+// FileColor returns the color ls shows a file of the given type in
+func FileColor(isDir bool, isExecutable bool, isSymlink bool) string {
+	switch {
+	case isDir:
+		return blue
+	case isSymlink:
+		return yellow
+	case isExecutable:
+		return cyan
+	default:
+		return green
+	}
+}
+
 // Nerd Fonts icons
 const (
 	iconFolder     = "" // Nerd Font icon for folders
@@ -51,33 +65,27 @@ const (
 )
 
 // customLS is a replacement for the `ls` command that shows files and folders with colors and icons.
-func CustomLS(args ...string) {
+func CustomLS(stdio *IO, args ...string) int {
+	out := stdio.Stdout
+
 	// Determine target directory
 	targetDir := "."
 	if len(args) > 0 {
 		targetDir = args[0]
 	}
 
-	// Handle ~ in path
-	if strings.HasPrefix(targetDir, "~") {
-		homeDir, err := os.UserHomeDir()
-		if err == nil {
-			targetDir = strings.Replace(targetDir, "~", homeDir, 1)
-		}
-	}
-
 	// Get absolute path
 	targetDir, err := filepath.Abs(targetDir)
 	if err != nil {
-		fmt.Printf("Error resolving path: %v\n", err)
-		return
+		fmt.Fprintf(stdio.Stderr, "Error resolving path: %v\n", err)
+		return 1
 	}
 
 	// Read directory contents
 	entries, err := os.ReadDir(targetDir)
 	if err != nil {
-		fmt.Println("Error:", err)
-		return
+		fmt.Fprintln(stdio.Stderr, "Error:", err)
+		return 1
 	}
 
 	var files []fileInfo
@@ -89,29 +97,26 @@ func CustomLS(args ...string) {
 			continue
 		}
 
-		var fileType, color string
+		var fileType string
 		mode := info.Mode()
 		isSymlink := mode&os.ModeSymlink != 0
 		isExecutable := mode&0111 != 0
 		isDir := entry.IsDir()
 
-		// Get appropriate icon
+		// Get appropriate icon and color
 		icon := GetFileIcon(info.Name(), isDir, isExecutable, isSymlink)
+		color := FileColor(isDir, isExecutable, isSymlink)
 
-		// Set type and color
+		// Set type
 		switch {
 		case isDir:
 			fileType = "Directory"
-			color = blue
 		case isSymlink:
 			fileType = "Symlink"
-			color = yellow
 		case isExecutable:
 			fileType = "Executable"
-			color = cyan
 		default:
 			fileType = "File"
-			color = green
 		}
 
 		files = append(files, fileInfo{
@@ -142,7 +147,7 @@ func CustomLS(args ...string) {
 		if len(f.name) > maxName {
 			maxName = len(f.name)
 		}
-		sizeStr := formatSize(f.size)
+		sizeStr := FormatSize(f.size)
 		if len(sizeStr) > maxSize {
 			maxSize = len(sizeStr)
 		}
@@ -152,7 +157,7 @@ func CustomLS(args ...string) {
 	}
 
 	// Print header
-	fmt.Printf("%s╭%s┬%s┬%s┬%s╮%s\n",
+	fmt.Fprintf(out, "%s╭%s┬%s┬%s┬%s╮%s\n",
 		gray,
 		strings.Repeat("─", maxName+4),
 		strings.Repeat("─", maxSize+2),
@@ -160,7 +165,7 @@ func CustomLS(args ...string) {
 		strings.Repeat("─", maxPerm+2),
 		reset)
 
-	fmt.Printf("%s│%s %s%-*s%s %s│%s %s%-*s%s %s│%s %s%-*s%s %s│%s %s%-*s%s %s│%s\n",
+	fmt.Fprintf(out, "%s│%s %s%-*s%s %s│%s %s%-*s%s %s│%s %s%-*s%s %s│%s %s%-*s%s %s│%s\n",
 		gray, reset,
 		yellow, maxName+2, "NAME", reset,
 		gray, reset,
@@ -171,7 +176,7 @@ func CustomLS(args ...string) {
 		yellow, maxPerm, "PERMISSIONS", reset,
 		gray, reset)
 
-	fmt.Printf("%s├%s┼%s┼%s┼%s┤%s\n",
+	fmt.Fprintf(out, "%s├%s┼%s┼%s┼%s┤%s\n",
 		gray,
 		strings.Repeat("─", maxName+4),
 		strings.Repeat("─", maxSize+2),
@@ -181,8 +186,8 @@ func CustomLS(args ...string) {
 
 	// Print files
 	for _, f := range files {
-		sizeStr := formatSize(f.size)
-		fmt.Printf("%s│%s %s%s %s%-*s%s %s│%s %-*s %s│%s %-*s %s│%s %-*s %s│%s\n",
+		sizeStr := FormatSize(f.size)
+		fmt.Fprintf(out, "%s│%s %s%s %s%-*s%s %s│%s %-*s %s│%s %-*s %s│%s %-*s %s│%s\n",
 			gray, reset,
 			f.color, f.icon, reset,
 			maxName, f.name,
@@ -197,11 +202,12 @@ func CustomLS(args ...string) {
 	}
 
 	// Print footer
-	fmt.Printf("%s╰%s┴%s┴%s┴%s╯%s\n",
+	fmt.Fprintf(out, "%s╰%s┴%s┴%s┴%s╯%s\n",
 		gray,
 		strings.Repeat("─", maxName+4),
 		strings.Repeat("─", maxSize+2),
 		strings.Repeat("─", maxType+2),
 		strings.Repeat("─", maxPerm+2),
 		reset)
+	return 0
 }
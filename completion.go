@@ -0,0 +1,375 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"formalshell/cmds"
+	"formalshell/completions"
+	"formalshell/parser"
+	"formalshell/shell"
+	"formalshell/vars"
+)
+
+// completer completes the word under the cursor at the prompt.
+var completer = &completions.Engine{
+	Commands:  completions.CompleterFunc(commandNames),
+	Arguments: completions.CompleterFunc(argumentCompletions),
+}
+
+// executables completes the names of the commands in $PATH.
+var executables = &completions.Executables{
+	Path: func() string { return customPath },
+}
+
+// commandNames completes a command name from the aliases, functions,
+// builtins and executables it could refer to.
+func commandNames(ctx *completions.Context) []completions.Candidate {
+	var candidates []completions.Candidate
+	for name, value := range aliases {
+		candidates = append(candidates, completions.Candidate{Text: name, Description: value})
+	}
+	for name := range mainShell.functions {
+		candidates = append(candidates, completions.Candidate{Text: name, Description: "function"})
+	}
+	for name := range builtins {
+		candidates = append(candidates, completions.Candidate{Text: name, Description: builtinHelp[name]})
+	}
+	return append(candidates, executables.Complete(ctx)...)
+}
+
+func init() {
+	aliasNames := completions.CompleterFunc(func(*completions.Context) []completions.Candidate {
+		candidates := make([]completions.Candidate, 0, len(aliases))
+		for name, value := range aliases {
+			candidates = append(candidates, completions.Candidate{Text: name, Description: value})
+		}
+		return candidates
+	})
+	completions.Register("alias", aliasNames)
+	completions.Register("unalias", aliasNames)
+
+	variableNames := completions.CompleterFunc(func(*completions.Context) []completions.Candidate {
+		var candidates []completions.Candidate
+		for _, name := range shellVars.Names() {
+			candidates = append(candidates, completions.Candidate{Text: name})
+		}
+		return candidates
+	})
+	completions.Register("export", variableNames)
+	completions.Register("unset", variableNames)
+
+	completions.Register("set", completions.CompleterFunc(func(ctx *completions.Context) []completions.Candidate {
+		if ctx.Prev() != "-o" && ctx.Prev() != "+o" {
+			return nil
+		}
+		var candidates []completions.Candidate
+		for name := range options {
+			candidates = append(candidates, completions.Candidate{Text: name})
+		}
+		return candidates
+	}))
+}
+
+// bashCompletion runs bash completion scripts, for the commands that have
+// one but no completion of their own here.
+var bashCompletion = &completions.Bash{
+	Path: func() string { return customPath },
+}
+
+// helpPages completes options and subcommands from what commands' --help
+// output and man pages say, cached in ~/.config/formalshell.
+var helpPages = &completions.HelpPages{
+	Path: func() string { return customPath },
+	File: helpCacheFile(),
+}
+
+// helpCacheFile returns where helpPages caches what it finds, or "" for
+// nowhere if there's no home directory.
+func helpCacheFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "formalshell", "completions.json")
+}
+
+// argumentCompletions completes the arguments of commands with no
+// completion registered: with bash's completion for the command, or else
+// the options and subcommands its help lists, if either has candidates
+// that match, and otherwise with file names.
+func argumentCompletions(ctx *completions.Context) []completions.Candidate {
+	if !ctx.Redirect {
+		for _, c := range []completions.Completer{bashCompletion, helpPages} {
+			candidates := c.Complete(ctx)
+			for _, candidate := range candidates {
+				if strings.HasPrefix(candidate.Text, ctx.Word()) {
+					return candidates
+				}
+			}
+		}
+	}
+	return completions.Files.Complete(ctx)
+}
+
+// completionShell runs the functions and commands named by completion
+// specs, in a copy of the state of the shell at the prompt. Functions are
+// the shell's own, or else bash functions loaded with bashcomp.
+type completionShell struct{}
+
+func (completionShell) CallFunction(name string, ctx *completions.Context) []completions.Candidate {
+	if fn, ok := mainShell.functions[name]; ok {
+		return callCompletionFunction(fn, ctx)
+	}
+	return bashCompletion.CallFunction(name, ctx)
+}
+
+// RunCommand runs command with the command name, the word being completed
+// and the word before it as arguments, as complete -C does.
+func (completionShell) RunCommand(command string, ctx *completions.Context) []string {
+	for _, arg := range []string{ctx.Words[0], ctx.Word(), ctx.Prev()} {
+		command += " " + shell.Quote(arg)
+	}
+	list, err := parser.Parse(command)
+	if err != nil {
+		return nil
+	}
+	out, err := completionOutput(ctx, func(stdio *cmds.IO) {
+		mainShell.subshell().runList(list, stdio, subJob)
+	})
+	if err != nil {
+		return nil
+	}
+	return strings.FieldsFunc(out, func(r rune) bool { return r == '\n' })
+}
+
+// callCompletionFunction runs a completion function the way bash's
+// `complete -F` does: with the command name, the word being completed and
+// the word before it as $1, $2 and $3. Each line it prints is a candidate,
+// optionally followed by a tab and a description.
+func callCompletionFunction(fn *parser.FuncDecl, ctx *completions.Context) []completions.Candidate {
+	out, err := completionOutput(ctx, func(stdio *cmds.IO) {
+		mainShell.subshell().callFunction(fn, []string{ctx.Words[0], ctx.Word(), ctx.Prev()}, stdio, subJob)
+	})
+	if err != nil {
+		return nil
+	}
+
+	var candidates []completions.Candidate
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		text, description, _ := strings.Cut(line, "\t")
+		candidates = append(candidates, completions.Candidate{Text: text, Description: description})
+	}
+	return candidates
+}
+
+// completionOutput calls run with COMP_LINE, COMP_POINT and COMP_CWORD set
+// for ctx and returns what it prints.
+func completionOutput(ctx *completions.Context, run func(stdio *cmds.IO)) (string, error) {
+	compVars := map[string]string{
+		"COMP_LINE":  ctx.Line,
+		"COMP_POINT": strconv.Itoa(ctx.Point),
+		"COMP_CWORD": strconv.Itoa(len(ctx.Words) - 1),
+	}
+	saved := make(map[string]*vars.Variable, len(compVars))
+	for name, value := range compVars {
+		saved[name] = shellVars.Lookup(name)
+		shellVars.Set(name, value)
+	}
+	defer func() {
+		for name, prev := range saved {
+			restoreVar(name, prev)
+		}
+	}()
+
+	// The terminal belongs to readline while completing
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return "", err
+	}
+	defer devNull.Close()
+	return captureOutput(devNull, run)
+}
+
+func init() {
+	completions.RegisterAction("alias", completions.CompleterFunc(func(*completions.Context) []completions.Candidate {
+		return wordCandidates(mapKeys(aliases))
+	}))
+	completions.RegisterAction("builtin", completions.CompleterFunc(builtinNames))
+	completions.RegisterAction("helptopic", completions.CompleterFunc(builtinNames))
+	completions.RegisterAction("command", completions.CompleterFunc(commandNames))
+	completions.RegisterAction("function", completions.CompleterFunc(func(*completions.Context) []completions.Candidate {
+		return wordCandidates(mapKeys(mainShell.functions))
+	}))
+	completions.RegisterAction("variable", completions.CompleterFunc(func(*completions.Context) []completions.Candidate {
+		return wordCandidates(shellVars.Names())
+	}))
+	completions.RegisterAction("export", completions.CompleterFunc(func(*completions.Context) []completions.Candidate {
+		var names []string
+		for _, name := range shellVars.Names() {
+			if v := shellVars.Lookup(name); v != nil && v.Exported {
+				names = append(names, name)
+			}
+		}
+		return wordCandidates(names)
+	}))
+	completions.RegisterAction("setopt", completions.CompleterFunc(func(*completions.Context) []completions.Candidate {
+		return wordCandidates(mapKeys(options))
+	}))
+}
+
+func builtinNames(*completions.Context) []completions.Candidate {
+	return wordCandidates(mapKeys(builtins))
+}
+
+// wordCandidates makes candidates of names.
+func wordCandidates(names []string) []completions.Candidate {
+	return completions.WordList(names).Complete(nil)
+}
+
+// mapKeys returns the keys of m.
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// completeBuiltin implements
+//
+//	complete [-p] [NAME ...]
+//	complete -r [NAME ...]
+//	complete [-abcdefgkuv] [-o OPTION] [-A ACTION] [-G GLOB] [-W WORDS]
+//	         [-F FUNCTION] [-C COMMAND] [-X FILTER] [-P PREFIX] [-S SUFFIX] NAME ...
+//
+// as in bash: the options define the completion of the arguments of each
+// NAME (see completions.Spec). -F calls a shell function, which prints the
+// candidates one per line, optionally followed by a tab and a description,
+// or else a bash function loaded with bashcomp, which sets COMPREPLY. -r
+// removes the completion for each NAME, or for every command, and -p lists
+// them.
+func completeBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	spec, flags, args, err := completions.ParseSpec(args, "pr")
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "complete: %v\n", err)
+		return 2
+	}
+	spec.Shell = completionShell{}
+
+	switch {
+	case strings.Contains(flags, "r"):
+		if len(args) == 0 {
+			args = completions.Registered()
+		}
+		for _, name := range args {
+			completions.Unregister(name)
+		}
+	case len(spec.Args()) > 0 && !strings.Contains(flags, "p"):
+		if len(args) == 0 {
+			fmt.Fprintln(stdio.Stderr, "complete: no command names given")
+			return 2
+		}
+		for _, name := range args {
+			completions.Register(name, spec)
+		}
+	default:
+		if len(args) == 0 {
+			args = completions.Registered()
+		}
+		status := 0
+		for _, name := range args {
+			c, ok := completions.Lookup(name)
+			if !ok {
+				fmt.Fprintf(stdio.Stderr, "complete: %s: no completion specification\n", name)
+				status = 1
+				continue
+			}
+			printCompletion(stdio, name, c)
+		}
+		return status
+	}
+	return 0
+}
+
+// printCompletion prints the completion for name as a complete command
+// that defines it again, or as a comment if it is built into the shell.
+func printCompletion(stdio *cmds.IO, name string, c completions.Completer) {
+	spec, ok := c.(*completions.Spec)
+	if !ok {
+		fmt.Fprintf(stdio.Stdout, "# %s: built-in completion\n", name)
+		return
+	}
+	line := "complete"
+	for _, arg := range spec.Args() {
+		line += " " + shell.Quote(arg)
+	}
+	fmt.Fprintf(stdio.Stdout, "%s %s\n", line, shell.Quote(name))
+}
+
+// compgenBuiltin implements
+//
+//	compgen [OPTION ...] [WORD]
+//
+// which prints the candidates the options of complete would produce for
+// WORD, one per line.
+func compgenBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	spec, _, args, err := completions.ParseSpec(args, "")
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "compgen: %v\n", err)
+		return 2
+	}
+	spec.Shell = completionShell{}
+
+	word := ""
+	if len(args) > 0 {
+		word = args[0]
+	}
+	line := []rune("compgen " + word)
+	candidates := spec.Complete(completions.NewContext(line, len(line)))
+	for _, candidate := range candidates {
+		fmt.Fprintln(stdio.Stdout, candidate.Text)
+	}
+	return boolStatus(len(candidates) > 0)
+}
+
+// bashcompBuiltin implements
+//
+//	bashcomp FILE ...
+//	bashcomp -c CODE
+//
+// which loads bash completion scripts, or runs CODE, in the bash that runs
+// bash completions, so that the completions and functions they define can
+// be used. Scripts installed where bash-completion looks for them are
+// loaded when needed without it.
+func bashcompBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if len(args) == 2 && args[0] == "-c" {
+		bashCompletion.Load(args[1])
+		return 0
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(stdio.Stderr, "usage: bashcomp FILE ... | bashcomp -c CODE")
+		return 2
+	}
+	status := 0
+	for _, file := range args {
+		// bash changes directory to complete in the right one
+		path, err := filepath.Abs(file)
+		if err == nil {
+			_, err = os.Stat(path)
+		}
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "bashcomp: %v\n", err)
+			status = 1
+			continue
+		}
+		bashCompletion.Load(". " + shell.Quote(path))
+	}
+	return status
+}
@@ -0,0 +1,341 @@
+package completions
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"formalshell/shell"
+)
+
+// bashTimeout is how long Bash waits for a completion function before
+// giving up on it and the bash running it.
+const bashTimeout = 3 * time.Second
+
+// bashBridge is the bash code Bash starts bash with. It loads
+// bash-completion if it is installed, and defines __fsh_complete, which
+// completes a command line the way bash's programmable completion does and
+// prints the options in effect and then COMPREPLY, each ended by a NUL,
+// and an empty string after the last. compopt is replaced so that the
+// options completion functions set with it are reported too.
+const bashBridge = `
+shopt -s extglob progcomp
+for __fsh_file in /usr/share/bash-completion/bash_completion \
+	/usr/local/share/bash-completion/bash_completion \
+	/opt/homebrew/share/bash-completion/bash_completion /etc/bash_completion; do
+	if [[ -r $__fsh_file ]]; then
+		. "$__fsh_file" >/dev/null 2>&1 </dev/null
+		break
+	fi
+done
+unset __fsh_file
+
+__fsh_load() {
+	local cmd=${1##*/} dir IFS=:
+	if declare -F _comp_load >/dev/null; then
+		_comp_load -- "$cmd"
+		return
+	fi
+	if declare -F __load_completion >/dev/null; then
+		__load_completion "$cmd"
+		return
+	fi
+	local dirs=("${BASH_COMPLETION_USER_DIR:-${XDG_DATA_HOME:-$HOME/.local/share}/bash-completion}/completions")
+	for dir in ${XDG_DATA_DIRS:-/usr/local/share:/usr/share}; do
+		dirs+=("$dir/bash-completion/completions")
+	done
+	dirs+=(/etc/bash_completion.d)
+	for dir in "${dirs[@]}"; do
+		if [[ -r $dir/$cmd ]]; then
+			. "$dir/$cmd"
+			return
+		fi
+	done
+}
+
+__fsh_parse() {
+	local OPTIND=1 opt
+	while getopts 'abcdefgjksuvA:o:G:W:F:C:X:P:S:DEI' opt; do
+		case $opt in
+		F) __fsh_fn=$OPTARG ;;
+		o) __fsh_options+=" $OPTARG" ;;
+		[AGWCXPS]) __fsh_args+=("-$opt" "$OPTARG") ;;
+		[DEI]) ;;
+		*) __fsh_args+=("-$opt") ;;
+		esac
+	done
+}
+
+compopt() {
+	local args=("$@")
+	while (($# >= 2)); do
+		case $1 in
+		-o) __fsh_options+=" $2" ;;
+		+o) __fsh_options=${__fsh_options// $2/} ;;
+		*) break ;;
+		esac
+		shift 2
+	done
+	if (($#)); then
+		builtin compopt "${args[@]}" 2>/dev/null
+	fi
+	return 0
+}
+
+__fsh_complete() {
+	local __fsh_fn=$1 __fsh_options= __fsh_args=() __fsh_spec
+	cd -- "$2" 2>/dev/null
+	local COMP_LINE=$3 COMP_POINT=$4 COMP_CWORD=$5 COMP_TYPE=9 COMP_KEY=9
+	shift 5
+	local COMP_WORDS=("$@") COMPREPLY=()
+	local cmd=$1 cur=${COMP_WORDS[COMP_CWORD]} prev=
+	((COMP_CWORD > 0)) && prev=${COMP_WORDS[COMP_CWORD-1]}
+
+	if [[ -z $__fsh_fn ]]; then
+		__fsh_spec=$(complete -p -- "$cmd" 2>/dev/null || complete -p -- "${cmd##*/}" 2>/dev/null)
+		if [[ -z $__fsh_spec ]]; then
+			__fsh_load "$cmd" >/dev/null 2>&1 </dev/null
+			__fsh_spec=$(complete -p -- "${cmd##*/}" 2>/dev/null)
+		fi
+		if [[ -z $__fsh_spec ]]; then
+			printf 'none\0\0'
+			return
+		fi
+		eval "__fsh_parse ${__fsh_spec#complete }"
+	fi
+
+	if [[ -n $__fsh_fn ]]; then
+		"$__fsh_fn" "$cmd" "$cur" "$prev" >/dev/null 2>&1 </dev/null
+	fi
+	if ((${#__fsh_args[@]})); then
+		mapfile -t -O "${#COMPREPLY[@]}" COMPREPLY < <(compgen "${__fsh_args[@]}" -- "$cur" 2>/dev/null </dev/null)
+	fi
+
+	printf '%s\0' "ok$__fsh_options"
+	local reply
+	for reply in "${COMPREPLY[@]}"; do
+		[[ -n $reply ]] && printf '%s\0' "$reply"
+	done
+	printf '\0'
+}
+`
+
+// bashWordBreaks are the characters in bash's COMP_WORDBREAKS that
+// NewContext doesn't already split words at.
+const bashWordBreaks = "=:"
+
+// Bash runs completions written for bash, such as the scripts
+// bash-completion installs for git or make and the functions they define,
+// in a bash process kept running for them. Bash is started when first
+// needed, and started again if a completion function hangs.
+type Bash struct {
+	// Path returns the $PATH to look bash up in and run completions with.
+	Path func() string
+
+	// scripts is the code given to Load, run again whenever bash starts.
+	scripts []string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+}
+
+// Load runs code in bash, now if it is running and whenever it starts,
+// typically to source a completion script.
+func (b *Bash) Load(code string) {
+	b.scripts = append(b.scripts, code)
+	if b.cmd != nil {
+		b.send(loadCode(code))
+	}
+}
+
+// loadCode wraps code so that nothing it prints gets in the way of the
+// replies Bash reads.
+func loadCode(code string) string {
+	return "{\n" + code + "\n} >/dev/null 2>&1 </dev/null\n"
+}
+
+// Complete completes with the completion bash has for the command in ctx,
+// loading it the way bash-completion does if it isn't loaded yet. It
+// returns nil when bash has none.
+func (b *Bash) Complete(ctx *Context) []Candidate {
+	return b.complete("", ctx)
+}
+
+// CallFunction completes with the bash function name, as complete -F does
+// in bash.
+func (b *Bash) CallFunction(name string, ctx *Context) []Candidate {
+	return b.complete(name, ctx)
+}
+
+// complete asks bash for the completions of the word in ctx, using
+// function or, when it is empty, the completion for the command.
+func (b *Bash) complete(function string, ctx *Context) []Candidate {
+	words, lead := splitWordBreaks(ctx.Words)
+	dir, _ := os.Getwd()
+	args := []string{function, dir, ctx.Command, strconv.Itoa(len([]rune(ctx.Command))), strconv.Itoa(len(words) - 1)}
+	args = append(args, words...)
+	for i, arg := range args {
+		args[i] = shell.Quote(arg)
+	}
+	reply, ok := b.request("PATH=" + shell.Quote(b.Path()) + " __fsh_complete " + strings.Join(args, " ") + "\n")
+	if !ok || len(reply) == 0 || !strings.HasPrefix(reply[0], "ok") {
+		return nil
+	}
+
+	spec := &Spec{Options: strings.Fields(strings.TrimPrefix(reply[0], "ok"))}
+	candidates := make([]Candidate, 0, len(reply)-1)
+	for _, text := range reply[1:] {
+		candidate := Candidate{Text: lead + text, NoSpace: spec.HasOption("nospace")}
+		// Some functions add the space themselves, leaving nospace set
+		if strings.HasSuffix(candidate.Text, " ") {
+			candidate.Text = strings.TrimRight(candidate.Text, " ")
+			candidate.NoSpace = false
+		}
+		if spec.HasOption("filenames") {
+			markDirectory(&candidate)
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	// Fall back on file names as bash would, after the word break: the
+	// caller can only complete the whole word
+	if len(candidates) == 0 && lead != "" && (spec.HasOption("default") || spec.HasOption("bashdefault")) {
+		rest := *ctx
+		rest.Words = append(ctx.Words[:len(ctx.Words)-1:len(ctx.Words)-1], ctx.Word()[len(lead):])
+		for _, candidate := range Files.Complete(&rest) {
+			candidate.Text = lead + candidate.Text
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// splitWordBreaks splits words at the characters in bashWordBreaks the way
+// bash does for completion functions, each run of them becoming a word of
+// its own. It also returns the part of the last word up to its last word
+// break, which bash leaves in place when it inserts a completion.
+func splitWordBreaks(words []string) (split []string, lead string) {
+	for i, word := range words {
+		if word == "" {
+			split = append(split, "")
+			continue
+		}
+		start := 0
+		for j := 1; j <= len(word); j++ {
+			if j == len(word) || isWordBreak(word[j]) != isWordBreak(word[j-1]) {
+				split = append(split, word[start:j])
+				start = j
+			}
+		}
+		if i == len(words)-1 {
+			if isWordBreak(word[len(word)-1]) {
+				lead = word
+			} else {
+				lead = word[:len(word)-len(split[len(split)-1])]
+			}
+		}
+	}
+	return split, lead
+}
+
+func isWordBreak(c byte) bool {
+	return strings.IndexByte(bashWordBreaks, c) >= 0
+}
+
+// request sends a command to bash and returns the NUL-terminated strings it
+// prints up to an empty one. It reports false if bash can't be run or
+// doesn't answer in time.
+func (b *Bash) request(command string) ([]string, bool) {
+	if !b.start() || !b.send(command) {
+		return nil, false
+	}
+
+	done := make(chan []string, 1)
+	go func(stdout *bufio.Reader) {
+		var reply []string
+		for {
+			s, err := stdout.ReadString(0)
+			if err != nil {
+				done <- nil
+				return
+			}
+			if s = strings.TrimSuffix(s, "\x00"); s == "" {
+				done <- reply
+				return
+			}
+			reply = append(reply, s)
+		}
+	}(b.stdout)
+
+	select {
+	case reply := <-done:
+		if reply == nil {
+			b.stop()
+		}
+		return reply, reply != nil
+	case <-time.After(bashTimeout):
+		b.stop()
+		return nil, false
+	}
+}
+
+// start starts bash if it isn't running, and reports whether it is.
+func (b *Bash) start() bool {
+	if b.cmd != nil {
+		return true
+	}
+	cmd, err := shell.Command("bash", []string{"--noprofile", "--norc"}, b.Path())
+	if err != nil {
+		return false
+	}
+	// Keep bash out of the terminal's way: it gets no signals from it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return false
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return false
+	}
+	if err := cmd.Start(); err != nil {
+		return false
+	}
+	b.cmd, b.stdin, b.stdout = cmd, stdin, bufio.NewReader(stdout)
+
+	if !b.send(bashBridge) {
+		return false
+	}
+	for _, code := range b.scripts {
+		if !b.send(loadCode(code)) {
+			return false
+		}
+	}
+	return true
+}
+
+// send writes s to bash, stopping it if that fails.
+func (b *Bash) send(s string) bool {
+	if _, err := io.WriteString(b.stdin, s); err != nil {
+		b.stop()
+		return false
+	}
+	return true
+}
+
+// stop kills bash, to be started again when next needed.
+func (b *Bash) stop() {
+	if b.cmd == nil {
+		return
+	}
+	b.stdin.Close()
+	// Its process group, so nothing a function started is left behind
+	syscall.Kill(-b.cmd.Process.Pid, syscall.SIGKILL)
+	b.cmd.Wait()
+	b.cmd, b.stdin, b.stdout = nil, nil, nil
+}
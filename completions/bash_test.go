@@ -0,0 +1,29 @@
+package completions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitWordBreaks(t *testing.T) {
+	tests := []struct {
+		words []string
+		split []string
+		lead  string
+	}{
+		{[]string{"git", "checkout"}, []string{"git", "checkout"}, ""},
+		{[]string{"make", "CC=gcc"}, []string{"make", "CC", "=", "gcc"}, "CC="},
+		{[]string{"ls", "--color="}, []string{"ls", "--color", "="}, "--color="},
+		{[]string{"scp", "host:/tmp/f"}, []string{"scp", "host", ":", "/tmp/f"}, "host:"},
+		{[]string{"x", "a=:b"}, []string{"x", "a", "=:", "b"}, "a=:"},
+		{[]string{"a=b", "c"}, []string{"a", "=", "b", "c"}, ""},
+		{[]string{"ls", ""}, []string{"ls", ""}, ""},
+		{[]string{"x", "=b"}, []string{"x", "=", "b"}, "="},
+	}
+	for _, tt := range tests {
+		split, lead := splitWordBreaks(tt.words)
+		if !reflect.DeepEqual(split, tt.split) || lead != tt.lead {
+			t.Errorf("splitWordBreaks(%q) = %q, %q, want %q, %q", tt.words, split, lead, tt.split, tt.lead)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package completions
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Executables completes command names from the executables in the
+// directories of a search path. A directory is read again only when its
+// modification time changes, as it does when a file is added or removed,
+// and directories that leave the path are forgotten. A name with a slash is
+// completed as a path to an executable instead.
+type Executables struct {
+	// Path returns the colon-separated search path.
+	Path func() string
+
+	path string
+	dirs map[string]*execDir
+}
+
+// execDir is the cached listing of one directory.
+type execDir struct {
+	modTime time.Time
+	names   []string
+}
+
+func (e *Executables) Complete(ctx *Context) []Candidate {
+	word := ctx.Word()
+	if strings.Contains(word, "/") {
+		return getPathCompletions(word, executablesOnly)
+	}
+
+	path := e.Path()
+	if path != e.path || e.dirs == nil {
+		kept := make(map[string]*execDir)
+		for _, dir := range filepath.SplitList(path) {
+			if cached, ok := e.dirs[dir]; ok {
+				kept[dir] = cached
+			}
+		}
+		e.path, e.dirs = path, kept
+	}
+
+	var candidates []Candidate
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		for _, name := range e.list(dir) {
+			if strings.HasPrefix(name, word) {
+				candidates = append(candidates, Candidate{Text: name})
+			}
+		}
+	}
+	return candidates
+}
+
+// list returns the names of the executables in dir, reading it only if it
+// changed since it was last read. Relative directories such as . are always
+// read, as they depend on the working directory.
+func (e *Executables) list(dir string) []string {
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		delete(e.dirs, dir)
+		return nil
+	}
+	cached, ok := e.dirs[dir]
+	if ok && cached.modTime.Equal(info.ModTime()) && filepath.IsAbs(dir) {
+		return cached.names
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		// isExecutable follows symlinks, which are common in bin directories
+		if isExecutable(filepath.Join(dir, entry.Name())) {
+			names = append(names, entry.Name())
+		}
+	}
+	e.dirs[dir] = &execDir{modTime: info.ModTime(), names: names}
+	return names
+}
@@ -0,0 +1,83 @@
+package completions
+
+import "sort"
+
+// Candidate is one possible completion of the word under the cursor.
+type Candidate struct {
+	// Text is the whole word, unquoted; the engine quotes it as needed.
+	Text string
+	// Description says what the candidate is, for showing beside it.
+	Description string
+	// NoSpace leaves the word open after the candidate is inserted, as
+	// for a directory that may be followed by more of the path.
+	NoSpace bool
+	// File describes the file a path candidate names, and is nil for other
+	// candidates.
+	File *File
+}
+
+// File describes the file named by a path candidate, so that a menu can
+// show it the way ls does.
+type File struct {
+	// Name is the last element of the path.
+	Name         string
+	IsDir        bool
+	IsExecutable bool
+	IsSymlink    bool
+	Size         int64
+}
+
+// Completer produces the candidates for the word under the cursor.
+// Candidates need not start with the word: the engine drops those that
+// don't.
+type Completer interface {
+	Complete(ctx *Context) []Candidate
+}
+
+// CompleterFunc adapts a function to a Completer.
+type CompleterFunc func(ctx *Context) []Candidate
+
+func (f CompleterFunc) Complete(ctx *Context) []Candidate {
+	return f(ctx)
+}
+
+// WordList completes from a fixed list of words.
+type WordList []string
+
+func (w WordList) Complete(ctx *Context) []Candidate {
+	candidates := make([]Candidate, len(w))
+	for i, word := range w {
+		candidates[i] = Candidate{Text: word}
+	}
+	return candidates
+}
+
+// specs maps command names to the completers for their arguments.
+var specs = make(map[string]Completer)
+
+// Register sets the completer for the arguments of command, replacing any
+// it had.
+func Register(command string, c Completer) {
+	specs[command] = c
+}
+
+// Unregister removes the completer for command.
+func Unregister(command string) {
+	delete(specs, command)
+}
+
+// Lookup returns the completer registered for command.
+func Lookup(command string) (Completer, bool) {
+	c, ok := specs[command]
+	return c, ok
+}
+
+// Registered returns the commands that have a completer, sorted.
+func Registered() []string {
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,167 @@
+package completions
+
+import (
+	"strings"
+
+	"formalshell/parser"
+)
+
+// Context describes the word being completed and the command it is part of.
+type Context struct {
+	// Line is the whole line being edited and Point the cursor's offset in
+	// it, in runes.
+	Line  string
+	Point int
+	// Words are the words of the command under the cursor, unquoted, up to
+	// and including the word being completed, which is empty when the
+	// cursor starts a new word. Assignments before the command name and
+	// redirections are left out.
+	Words []string
+	// Raw is the word being completed as it was typed, quotes included.
+	Raw string
+	// Quote is the quote left open in the word being completed, or 0.
+	Quote rune
+	// Redirect is set when the word is the target of a redirection.
+	Redirect bool
+	// Command is the text of the command under the cursor, from its name
+	// up to the cursor.
+	Command string
+}
+
+// Word returns the word being completed.
+func (c *Context) Word() string {
+	return c.Words[len(c.Words)-1]
+}
+
+// Prev returns the word before the one being completed, or "" when it is
+// the command name.
+func (c *Context) Prev() string {
+	if len(c.Words) < 2 {
+		return ""
+	}
+	return c.Words[len(c.Words)-2]
+}
+
+// commandKeywords are the reserved words after which a command name is
+// expected, or that end a command.
+var commandKeywords = map[string]bool{
+	"if": true, "then": true, "else": true, "elif": true, "fi": true,
+	"while": true, "until": true, "do": true, "done": true, "esac": true,
+	"!": true, "{": true, "}": true,
+}
+
+// NewContext works out which word of which command the cursor is in. Only
+// the text before the cursor counts: the command is the last one started
+// there, after any separator, pipe, opening parenthesis or keyword, so
+// `cd /tmp && gi` completes `gi` as a command name.
+func NewContext(line []rune, pos int) *Context {
+	ctx := &Context{Line: string(line), Point: pos}
+
+	var (
+		words    []string
+		cur      strings.Builder
+		inWord   bool
+		quoted   bool
+		start    int
+		escaped  bool
+		quote    rune
+		redirect bool
+		// command is where the command's name starts
+		command int
+	)
+	endWord := func() {
+		if !inWord {
+			return
+		}
+		word := cur.String()
+		switch {
+		case redirect:
+			redirect = false
+		case len(words) == 0 && (commandKeywords[word] && !quoted || isAssignment(word)):
+		default:
+			if len(words) == 0 {
+				command = start
+			}
+			words = append(words, word)
+		}
+		cur.Reset()
+		inWord, quoted = false, false
+	}
+	startWord := func(i int) {
+		if !inWord {
+			inWord, start = true, i
+		}
+	}
+
+	for i, r := range line[:pos] {
+		switch {
+		case escaped:
+			// Inside double quotes a backslash only escapes a few characters
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", r) {
+				cur.WriteRune('\\')
+			}
+			cur.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				cur.WriteRune(r)
+			}
+		case r == '\\':
+			startWord(i)
+			quoted, escaped = true, true
+		case r == '\'' || r == '"':
+			startWord(i)
+			quoted, quote = true, r
+		case r == ' ' || r == '\t':
+			endWord()
+		case r == '<' || r == '>':
+			// A file descriptor number belongs to the redirection
+			if inWord && !quoted && strings.Trim(cur.String(), "0123456789") == "" {
+				cur.Reset()
+				inWord = false
+			}
+			endWord()
+			redirect = true
+		case r == '&' && i > 0 && (line[i-1] == '<' || line[i-1] == '>'):
+		case strings.ContainsRune(";&|()`\n", r):
+			endWord()
+			words, redirect = nil, false
+		default:
+			startWord(i)
+			cur.WriteRune(r)
+		}
+	}
+
+	if inWord {
+		ctx.Raw = string(line[start:pos])
+	}
+	switch {
+	case len(words) > 0:
+	case inWord:
+		command = start
+	default:
+		command = pos
+	}
+	ctx.Command = string(line[command:pos])
+	ctx.Words = append(words, cur.String())
+	ctx.Quote = quote
+	ctx.Redirect = redirect
+	return ctx
+}
+
+// isAssignment reports whether word has the form NAME=value.
+func isAssignment(word string) bool {
+	name, _, ok := strings.Cut(word, "=")
+	return ok && parser.IsName(name)
+}
@@ -5,103 +5,101 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/chzyer/readline"
+	"formalshell/cmds"
+	"formalshell/expand"
 )
 
-// getDirCompletions returns directory completions for a given path prefix
-func getDirCompletions(prefix string) []string {
-	// If prefix is empty, use current directory
-	searchDir := "."
-	searchPrefix := ""
+// pathKind selects which directory entries getPathCompletions returns.
+type pathKind int
 
-	// Handle home directory expansion
-	if strings.HasPrefix(prefix, "~/") {
-		if homeDir, err := os.UserHomeDir(); err == nil {
-			prefix = filepath.Join(homeDir, prefix[2:])
-		}
+const (
+	anyFile pathKind = iota
+	dirsOnly
+	// executablesOnly keeps directories too, as they lead to executables.
+	executablesOnly
+)
+
+// getPathCompletions returns the completions of a path prefix: the entries
+// of the directory named by the prefix up to its last slash whose names
+// start with the rest. That directory may start with ~ and be absolute or
+// relative to the working directory, and is kept as typed in the
+// candidates. Directories, including symlinks to them, end in a slash so
+// completion can carry on inside them. Hidden entries are only returned
+// when the name being completed starts with a dot.
+func getPathCompletions(prefix string, kind pathKind) []Candidate {
+	if prefix == "~" {
+		return []Candidate{{Text: "~/", NoSpace: true}}
 	}
 
-	// Handle special paths
-	if prefix != "" {
-		switch {
-		case strings.HasPrefix(prefix, "~/"):
-			// Home directory
-			if homeDir, err := os.UserHomeDir(); err == nil {
-				searchDir = filepath.Join(homeDir, filepath.Dir(prefix[2:]))
-				searchPrefix = filepath.Base(prefix)
-			}
-		case strings.HasPrefix(prefix, "../"):
-			// Parent directory
-			if currentDir, err := os.Getwd(); err == nil {
-				searchDir = filepath.Join(currentDir, filepath.Dir(prefix))
-				searchPrefix = filepath.Base(prefix)
-			}
-		case strings.HasPrefix(prefix, "./"):
-			// Current directory
-			if currentDir, err := os.Getwd(); err == nil {
-				searchDir = filepath.Join(currentDir, filepath.Dir(prefix[2:]))
-				searchPrefix = filepath.Base(prefix)
-			}
-		default:
-			// Regular path
-			searchDir = filepath.Dir(prefix)
-			if searchDir == "." {
-				searchPrefix = prefix
-			} else {
-				searchPrefix = filepath.Base(prefix)
-			}
-		}
+	// Split the prefix into the directory to read and the name to complete
+	dir, base := "", prefix
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir, base = prefix[:i+1], prefix[i+1:]
+	}
+	searchDir := "."
+	if dir != "" {
+		searchDir = expand.Tilde(dir)
 	}
 
-	// Read the directory
 	entries, err := os.ReadDir(searchDir)
 	if err != nil {
 		return nil
 	}
 
-	var completions []string
+	var candidates []Candidate
 	for _, entry := range entries {
-		if entry.IsDir() {
-			name := entry.Name()
-			if searchPrefix == "" || strings.HasPrefix(strings.ToLower(name), strings.ToLower(searchPrefix)) {
-				if searchDir == "." {
-					completions = append(completions, name)
-				} else {
-					completions = append(completions, filepath.Join(filepath.Dir(prefix), name))
-				}
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+
+		// Symlinks are judged by what they point to
+		info, err := os.Stat(filepath.Join(searchDir, name))
+		if err != nil {
+			if info, err = entry.Info(); err != nil {
+				continue
 			}
 		}
-	}
+		file := &File{
+			Name:         name,
+			IsDir:        info.IsDir(),
+			IsExecutable: info.Mode().IsRegular() && info.Mode()&0111 != 0,
+			IsSymlink:    entry.Type()&os.ModeSymlink != 0,
+			Size:         info.Size(),
+		}
+		switch {
+		case kind == dirsOnly && !file.IsDir:
+			continue
+		case kind == executablesOnly && !file.IsDir && !file.IsExecutable:
+			continue
+		}
 
-	return completions
+		if file.IsDir {
+			candidates = append(candidates, Candidate{Text: dir + name + "/", NoSpace: true, File: file})
+		} else {
+			candidates = append(candidates, Candidate{Text: dir + name, Description: cmds.FormatSize(file.Size), File: file})
+		}
+	}
+	return candidates
 }
 
-// CreateCompleter returns a readline.PrefixCompleter for the shell
-func CreateCompleter(commandHistory map[string]bool) *readline.PrefixCompleter {
-	var completions []readline.PrefixCompleterInterface
-
-	// Add built-in commands with directory completion for cd
-	cdCompleter := readline.PcItem("cd",
-		readline.PcItemDynamic(func(line string) []string {
-			parts := strings.Fields(line)
-			if len(parts) <= 1 {
-				// Show all directories in current directory
-				return getDirCompletions("")
-			}
-			// Get the partial path after "cd "
-			partial := strings.TrimPrefix(line, "cd ")
-			partial = strings.TrimSpace(partial)
-			return getDirCompletions(partial)
-		}))
+// isExecutable reports whether file is a regular file that can be run.
+func isExecutable(file string) bool {
+	info, err := os.Stat(file)
+	return err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0
+}
 
-	completions = append(completions, cdCompleter)
+// Files completes paths to files and directories. It is the completion for
+// the arguments of commands that have none of their own.
+var Files = CompleterFunc(func(ctx *Context) []Candidate {
+	return getPathCompletions(ctx.Word(), anyFile)
+})
 
-	// Add command history completions
-	for cmd := range commandHistory {
-		if !strings.HasPrefix(cmd, "cd ") { // Skip cd commands from history
-			completions = append(completions, readline.PcItem(cmd))
-		}
-	}
+// Directories completes paths to directories, for commands such as cd.
+var Directories = CompleterFunc(func(ctx *Context) []Candidate {
+	return getPathCompletions(ctx.Word(), dirsOnly)
+})
 
-	return readline.NewPrefixCompleter(completions...)
+func init() {
+	Register("cd", Directories)
 }
@@ -0,0 +1,99 @@
+package completions
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Engine completes the word under the cursor, picking a completer by where
+// the word is in its command: command names, then the completer registered
+// for the command, if any, for its arguments.
+type Engine struct {
+	// Commands completes command names.
+	Commands Completer
+	// Arguments completes the arguments of commands with no completer of
+	// their own, and redirection targets.
+	Arguments Completer
+}
+
+// Complete returns the candidates for the word in ctx that start with it,
+// sorted and without duplicates.
+func (e *Engine) Complete(ctx *Context) []Candidate {
+	c := e.Arguments
+	if len(ctx.Words) == 1 && !ctx.Redirect {
+		c = e.Commands
+	} else if spec, ok := Lookup(ctx.Words[0]); ok && !ctx.Redirect {
+		c = spec
+	}
+	if c == nil {
+		return nil
+	}
+
+	word := ctx.Word()
+	seen := make(map[string]bool)
+	var candidates []Candidate
+	for _, candidate := range c.Complete(ctx) {
+		if !strings.HasPrefix(candidate.Text, word) || seen[candidate.Text] {
+			continue
+		}
+		seen[candidate.Text] = true
+		candidates = append(candidates, candidate)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Text < candidates[j].Text
+	})
+	return candidates
+}
+
+// CommonPrefix returns the longest text every candidate starts with.
+func CommonPrefix(candidates []Candidate) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+	prefix := candidates[0].Text
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate.Text, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	return prefix
+}
+
+// Insertion returns the text to replace the word in ctx with, as typed,
+// to complete it to candidate: the word as it was typed, then the rest of
+// the candidate quoted to match, and a closing quote and space unless the
+// candidate leaves the word open.
+func Insertion(ctx *Context, candidate Candidate) string {
+	text := ctx.Raw + Quote(candidate.Text[len(ctx.Word()):], ctx.Quote)
+	if candidate.NoSpace {
+		return text
+	}
+	if ctx.Quote != 0 {
+		text += string(ctx.Quote)
+	}
+	return text + " "
+}
+
+// Quote escapes s for use inside a word left open with quote, or outside
+// quotes when quote is 0.
+func Quote(s string, quote rune) string {
+	var special string
+	switch quote {
+	case '\'':
+		return strings.ReplaceAll(s, "'", `'\''`)
+	case '"':
+		special = "\"$`\\"
+	default:
+		special = " \t\n\\'\"$`&|;<>()*?[]#!{}"
+	}
+	var sb strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
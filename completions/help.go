@@ -0,0 +1,374 @@
+package completions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"formalshell/shell"
+)
+
+// helpTimeout is how long a command gets to print its --help.
+const helpTimeout = 2 * time.Second
+
+// HelpPages completes the options and subcommands of commands from what
+// their --help output and man pages say about them. What is found for an
+// executable is cached in File until the executable changes.
+//
+// Running a command that doesn't understand --help may well do something
+// else, so only commands found in $PATH are run with it, never scripts or
+// ones named by a path, and only when completing an option. Subcommands
+// come from what is cached or from man pages until then. Man pages are
+// always read.
+type HelpPages struct {
+	// Path returns the $PATH to look commands up in.
+	Path func() string
+	// File is where the pages are cached, kept by the path and
+	// modification time of each executable.
+	File string
+
+	cache  map[string]*helpEntry
+	loaded bool
+}
+
+// helpEntry is what was found for an executable.
+type helpEntry struct {
+	ModTime time.Time `json:"mod_time"`
+	// Pages are the pages of the command itself, under "", and of its
+	// subcommands, under their names.
+	Pages map[string]*helpPage `json:"pages"`
+}
+
+// helpPage lists what a command or subcommand takes.
+type helpPage struct {
+	Options     []helpItem `json:"options,omitempty"`
+	Subcommands []helpItem `json:"subcommands,omitempty"`
+}
+
+// helpItem is an option or subcommand with what its page says of it. An
+// option ending in = takes its value in the same word.
+type helpItem struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// Complete returns the options of the command in ctx when the word starts
+// with a dash, taking them from the subcommand's page after a subcommand,
+// and its subcommands for its first argument.
+func (h *HelpPages) Complete(ctx *Context) []Candidate {
+	if len(ctx.Words) < 2 || ctx.Redirect {
+		return nil
+	}
+	name := ctx.Words[0]
+	path, err := shell.LookPath(name, h.Path())
+	if err != nil {
+		return nil
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	var items []helpItem
+	switch word := ctx.Word(); {
+	case strings.HasPrefix(word, "-"):
+		subcommand := ""
+		if len(ctx.Words) > 2 && h.hasSubcommand(name, path, info.ModTime(), ctx.Words[1]) {
+			subcommand = ctx.Words[1]
+		}
+		items = h.page(name, path, info.ModTime(), subcommand, canRun(name)).Options
+	case len(ctx.Words) == 2:
+		items = h.page(name, path, info.ModTime(), "", false).Subcommands
+	}
+
+	candidates := make([]Candidate, len(items))
+	for i, item := range items {
+		candidates[i] = Candidate{
+			Text:        item.Name,
+			Description: item.Description,
+			NoSpace:     strings.HasSuffix(item.Name, "="),
+		}
+	}
+	return candidates
+}
+
+// hasSubcommand reports whether the command's page lists subcommand.
+func (h *HelpPages) hasSubcommand(name, path string, modTime time.Time, subcommand string) bool {
+	for _, item := range h.page(name, path, modTime, "", canRun(name)).Subcommands {
+		if item.Name == subcommand {
+			return true
+		}
+	}
+	return false
+}
+
+// canRun reports whether the command name may be run with --help: it must
+// be looked up in $PATH rather than named by a path.
+func canRun(name string) bool {
+	return !strings.Contains(name, "/")
+}
+
+// page returns the page of the command name, whose executable is at path,
+// or of one of its subcommands, from the cache if the executable hasn't
+// changed since it was made. Otherwise the page is made, running the
+// command with --help if run is set; a page made without running it is
+// only read from the man page and isn't cached.
+func (h *HelpPages) page(name, path string, modTime time.Time, subcommand string, run bool) *helpPage {
+	h.load()
+	entry, ok := h.cache[path]
+	if !ok || !entry.ModTime.Equal(modTime) {
+		entry = &helpEntry{ModTime: modTime, Pages: make(map[string]*helpPage)}
+		h.cache[path] = entry
+	}
+	if page, ok := entry.Pages[subcommand]; ok {
+		return page
+	}
+
+	page := makeHelpPage(filepath.Base(name), path, subcommand, run, h.Path())
+	if run {
+		entry.Pages[subcommand] = page
+		h.save()
+	}
+	return page
+}
+
+// load reads the cache the first time it is needed.
+func (h *HelpPages) load() {
+	if h.loaded {
+		return
+	}
+	h.loaded = true
+	h.cache = make(map[string]*helpEntry)
+	if data, err := os.ReadFile(h.File); err == nil {
+		json.Unmarshal(data, &h.cache)
+	}
+}
+
+func (h *HelpPages) save() {
+	if h.File == "" {
+		return
+	}
+	data, err := json.MarshalIndent(h.cache, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(h.File), 0755); err != nil {
+		return
+	}
+	os.WriteFile(h.File, data, 0644)
+}
+
+// makeHelpPage gathers the options and subcommands of a command, or of one
+// of its subcommands, from its --help output if run is set and then its man
+// page, named like git-commit for a subcommand. Scripts are never run.
+func makeHelpPage(name, path, subcommand string, run bool, searchPath string) *helpPage {
+	page := &helpPage{}
+	args := []string{"--help"}
+	manName := name
+	if subcommand != "" {
+		args = []string{subcommand, "--help"}
+		manName = name + "-" + subcommand
+	}
+
+	if run && !isScript(path) {
+		options, subcommands := parseHelp(runHelp(path, args, searchPath))
+		page.add(options, subcommands)
+	}
+	if src := findManPage(manName, path); src != "" {
+		options, subcommands := manPageItems(parseManPage(src), manName)
+		page.add(options, subcommands)
+	}
+	if subcommand != "" {
+		page.Subcommands = nil
+	}
+	return page
+}
+
+// add adds the options and subcommands that aren't on the page yet.
+func (p *helpPage) add(options, subcommands []helpItem) {
+	p.Options = mergeItems(p.Options, options)
+	p.Subcommands = mergeItems(p.Subcommands, subcommands)
+}
+
+// mergeItems appends the items of more with names not in items, filling
+// in descriptions items lack.
+func mergeItems(items, more []helpItem) []helpItem {
+	index := make(map[string]int, len(items))
+	for i, item := range items {
+		index[item.Name] = i
+	}
+	for _, item := range more {
+		if i, ok := index[item.Name]; ok {
+			if items[i].Description == "" {
+				items[i].Description = item.Description
+			}
+			continue
+		}
+		index[item.Name] = len(items)
+		items = append(items, item)
+	}
+	return items
+}
+
+// isScript reports whether the file at path starts with #!.
+func isScript(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	n, _ := f.Read(magic)
+	return n == 2 && string(magic) == "#!"
+}
+
+// runHelp runs the executable at path with args, with no input and pagers
+// that just print, and returns what it prints on stdout, or on stderr if
+// that is all it printed. It is killed with everything it started if it
+// takes too long.
+func runHelp(path string, args []string, searchPath string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), helpTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = append(shell.Environ(searchPath), "PAGER=cat", "MANPAGER=cat", "GIT_PAGER=cat", "NO_COLOR=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = helpTimeout
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	cmd.Run()
+
+	if stdout.Len() == 0 {
+		return stderr.String()
+	}
+	return stdout.String()
+}
+
+var (
+	// helpSplit separates the options or subcommand on a line of --help
+	// output from the description after them.
+	helpSplit = regexp.MustCompile(`\s{2,}|\t`)
+	// optionName finds the options in the text that names them, such as
+	// "-o, --output=FILE", and whether they take a value after an =.
+	optionName = regexp.MustCompile(`(?:^|[\s,|/\[])(--?[A-Za-z0-9][\w.+-]*)(\[?=)?`)
+	// subcommandName is what a subcommand looks like.
+	subcommandName = regexp.MustCompile(`^[a-z][a-z0-9_.:-]*$`)
+	// ansiEscape matches the colors some commands print anyway.
+	ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m|.\x08`)
+)
+
+// parseHelp finds the options and subcommands listed in --help output.
+// Options are on lines that start with a dash, with a description after
+// them or on the next line, more indented. Subcommands are lines of a name
+// and a description, under a heading that mentions commands.
+func parseHelp(text string) (options, subcommands []helpItem) {
+	lines := strings.Split(ansiEscape.ReplaceAllString(text, ""), "\n")
+	inCommands := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+
+		if indent == 0 && strings.HasSuffix(trimmed, ":") {
+			inCommands = strings.Contains(strings.ToLower(trimmed), "command")
+			continue
+		}
+		if indent == 0 || indent > 16 || trimmed == "" {
+			continue
+		}
+
+		names, description := trimmed, ""
+		if loc := helpSplit.FindStringIndex(trimmed); loc != nil {
+			names, description = trimmed[:loc[0]], strings.TrimSpace(trimmed[loc[1]:])
+		}
+		if description == "" && i+1 < len(lines) {
+			next := lines[i+1]
+			if nextIndent := len(next) - len(strings.TrimLeft(next, " \t")); nextIndent > indent &&
+				!strings.HasPrefix(strings.TrimSpace(next), "-") {
+				description = strings.TrimSpace(next)
+			}
+		}
+
+		switch {
+		case strings.HasPrefix(names, "-"):
+			options = append(options, optionItems(names, description)...)
+		case inCommands && description != "":
+			for _, name := range strings.Split(names, ",") {
+				if name = strings.TrimSpace(name); subcommandName.MatchString(name) {
+					subcommands = append(subcommands, helpItem{Name: name, Description: firstSentence(description)})
+				}
+			}
+		}
+	}
+	return options, subcommands
+}
+
+// manPageItems picks the options and subcommands out of the tagged
+// paragraphs of the man page for command: tags that start with a dash are
+// options, and single words under a heading that mentions commands are
+// subcommands, given as they are or as git-style pages, like git-add(1).
+func manPageItems(items []manItem, command string) (options, subcommands []helpItem) {
+	for _, item := range items {
+		if strings.HasPrefix(item.tag, "-") {
+			options = append(options, optionItems(item.tag, item.text)...)
+			continue
+		}
+		if !strings.Contains(item.section, "COMMAND") {
+			continue
+		}
+		name := item.tag
+		if i := strings.IndexByte(name, '('); i > 0 {
+			name = name[:i]
+		}
+		name = strings.TrimPrefix(name, command+"-")
+		if subcommandName.MatchString(name) && name != command {
+			subcommands = append(subcommands, helpItem{Name: name, Description: firstSentence(item.text)})
+		}
+	}
+	return options, subcommands
+}
+
+// optionItems returns the options named in names, such as "-a, --all" or
+// "--width=COLS", each with description.
+func optionItems(names, description string) []helpItem {
+	var items []helpItem
+	description = firstSentence(description)
+	for _, m := range optionName.FindAllStringSubmatch(names, -1) {
+		name := m[1]
+		if m[2] == "=" {
+			name += "="
+		}
+		items = append(items, helpItem{Name: name, Description: description})
+	}
+	return items
+}
+
+// firstSentence returns the first sentence of text, with its spaces
+// collapsed, cut short if it is long.
+func firstSentence(text string) string {
+	// A sentence ends at a period after a word, not one standing alone
+	// as in "entries starting with ."
+	text = strings.Join(strings.Fields(text), " ")
+	for i := 1; i < len(text); i++ {
+		if text[i] == '.' && text[i-1] != ' ' && text[i-1] != '.' && (i+1 == len(text) || text[i+1] == ' ') {
+			text = text[:i]
+			break
+		}
+	}
+	if r := []rune(text); len(r) > 80 {
+		text = string(r[:79]) + "…"
+	}
+	return text
+}
@@ -0,0 +1,167 @@
+package completions
+
+import (
+	"reflect"
+	"testing"
+)
+
+const gitHelp = `usage: git [-v | --version] [-h | --help] [-C <path>]
+           <command> [<args>]
+
+These are common Git commands used in various situations:
+
+start a working area (see also: git help tutorial)
+   clone     Clone a repository into a new directory
+   init      Create an empty Git repository or reinitialize an existing one
+
+work on the current change (see also: git help everyday)
+   add       Add file contents to the index
+   mv        Move or rename a file, a directory, or a symlink
+`
+
+const lsHelp = "Usage: ls [OPTION]... [FILE]...\n" +
+	"List information about the FILEs (the current directory by default).\n" +
+	"\n" +
+	"Mandatory arguments to long options are mandatory for short options too.\n" +
+	"  -a, --all                  do not ignore entries starting with .\n" +
+	"  -A, --almost-all           do not list implied . and ..\n" +
+	"      --block-size=SIZE      with -l, scale sizes by SIZE when printing them;\n" +
+	"                               e.g., '--block-size=M'; see SIZE format below\n" +
+	"  -C                         list entries by columns\n" +
+	"      --color[=WHEN]         color the output WHEN; more info below\n" +
+	"  -w, --width=COLS           set output width to COLS.  0 means no limit\n" +
+	"      --help     display this help and exit\n"
+
+const cargoHelp = "Commands:\n" +
+	"    build, b    Compile the current package\n" +
+	"    check, c    Analyze the current package and report errors, but don't build object files\n" +
+	"    new         Create a new cargo package\n" +
+	"\n" +
+	"Options:\n" +
+	"  -V, --version\n" +
+	"          Print version info and exit\n" +
+	"  -q, --quiet\n" +
+	"          Do not print cargo log messages\n" +
+	"      --color <WHEN>  Coloring: auto, always, never\n"
+
+func TestParseHelp(t *testing.T) {
+	tests := []struct {
+		name        string
+		text        string
+		options     []helpItem
+		subcommands []helpItem
+	}{
+		{
+			name: "git",
+			text: gitHelp,
+			subcommands: []helpItem{
+				{"clone", "Clone a repository into a new directory"},
+				{"init", "Create an empty Git repository or reinitialize an existing one"},
+				{"add", "Add file contents to the index"},
+				{"mv", "Move or rename a file, a directory, or a symlink"},
+			},
+		},
+		{
+			name: "ls",
+			text: lsHelp,
+			options: []helpItem{
+				{"-a", "do not ignore entries starting with ."},
+				{"--all", "do not ignore entries starting with ."},
+				{"-A", "do not list implied . and .."},
+				{"--almost-all", "do not list implied . and .."},
+				{"--block-size=", "with -l, scale sizes by SIZE when printing them;"},
+				{"-C", "list entries by columns"},
+				{"--color", "color the output WHEN; more info below"},
+				{"-w", "set output width to COLS"},
+				{"--width=", "set output width to COLS"},
+				{"--help", "display this help and exit"},
+			},
+		},
+		{
+			name: "cargo",
+			text: cargoHelp,
+			options: []helpItem{
+				{"-V", "Print version info and exit"},
+				{"--version", "Print version info and exit"},
+				{"-q", "Do not print cargo log messages"},
+				{"--quiet", "Do not print cargo log messages"},
+				{"--color", "Coloring: auto, always, never"},
+			},
+			subcommands: []helpItem{
+				{"build", "Compile the current package"},
+				{"b", "Compile the current package"},
+				{"check", "Analyze the current package and report errors, but don't build object files"},
+				{"c", "Analyze the current package and report errors, but don't build object files"},
+				{"new", "Create a new cargo package"},
+			},
+		},
+		{
+			name: "colors",
+			text: "Options:\n  \x1b[1m-v\x1b[0m, \x1b[1m--verbose\x1b[0m  Say more\n",
+			options: []helpItem{
+				{"-v", "Say more"},
+				{"--verbose", "Say more"},
+			},
+		},
+		{
+			name: "nothing",
+			text: "usage: tool FILE\n\nTool does one thing.\n",
+		},
+	}
+	for _, tt := range tests {
+		options, subcommands := parseHelp(tt.text)
+		if !reflect.DeepEqual(options, tt.options) {
+			t.Errorf("%s: options = %q, want %q", tt.name, options, tt.options)
+		}
+		if !reflect.DeepEqual(subcommands, tt.subcommands) {
+			t.Errorf("%s: subcommands = %q, want %q", tt.name, subcommands, tt.subcommands)
+		}
+	}
+}
+
+func TestFirstSentence(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"Show the status. Then exit.", "Show the status"},
+		{"do not ignore entries starting with .", "do not ignore entries starting with ."},
+		{"list implied . and .. too. More", "list implied . and .. too"},
+		{"see e.g. this", "see e.g"},
+		{"  spread\n   over   lines  ", "spread over lines"},
+		{"version 1.2 is used", "version 1.2 is used"},
+		{"", ""},
+		{
+			"a very long description that goes on and on well past the point where a menu has any room left for it",
+			"a very long description that goes on and on well past the point where a menu ha…",
+		},
+	}
+	for _, tt := range tests {
+		if got := firstSentence(tt.text); got != tt.want {
+			t.Errorf("firstSentence(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestOptionItems(t *testing.T) {
+	tests := []struct {
+		names string
+		want  []string
+	}{
+		{"-a, --all", []string{"-a", "--all"}},
+		{"--width=COLS", []string{"--width="}},
+		{"--color[=WHEN]", []string{"--color"}},
+		{"-o FILE, --output FILE", []string{"-o", "--output"}},
+		{"-h|--help", []string{"-h", "--help"}},
+		{"--no-pager", []string{"--no-pager"}},
+		{"-", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, item := range optionItems(tt.names, "") {
+			got = append(got, item.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("optionItems(%q) = %q, want %q", tt.names, got, tt.want)
+		}
+	}
+}
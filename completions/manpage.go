@@ -0,0 +1,339 @@
+package completions
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// manSections are the sections of the manual that document commands.
+var manSections = []string{"1", "8", "6"}
+
+// findManPage returns the groff source of the man page for name, looking
+// in $MANPATH or else in the man directories beside the executable at path
+// and the usual ones.
+func findManPage(name, path string) string {
+	var dirs []string
+	if manpath := os.Getenv("MANPATH"); manpath != "" {
+		dirs = filepath.SplitList(manpath)
+	}
+	prefix := filepath.Dir(filepath.Dir(path))
+	dirs = append(dirs, filepath.Join(prefix, "share", "man"), filepath.Join(prefix, "man"),
+		"/usr/local/share/man", "/usr/share/man")
+
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		for _, section := range manSections {
+			base := filepath.Join(dir, "man"+section, name+"."+section)
+			for _, file := range []string{base, base + ".gz", base + ".bz2"} {
+				if src, ok := readManFile(file, dir, true); ok {
+					return src
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// readManFile reads a man page, uncompressing it if needs be. A page that
+// only includes another with .so is followed once to that page, named
+// relative to root.
+func readManFile(file, root string, follow bool) (string, bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch filepath.Ext(file) {
+	case ".gz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return "", false
+		}
+		r = gz
+	case ".bz2":
+		r = bzip2.NewReader(f)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(r, 4<<20)); err != nil {
+		return "", false
+	}
+	src := buf.String()
+
+	if target, ok := strings.CutPrefix(strings.TrimSpace(src), ".so "); ok && follow && !strings.Contains(target, "\n") {
+		target = filepath.Join(root, strings.TrimSpace(target))
+		for _, file := range []string{target, target + ".gz", target + ".bz2"} {
+			if src, ok := readManFile(file, root, false); ok {
+				return src, true
+			}
+		}
+		return "", false
+	}
+	return src, true
+}
+
+// manItem is a tagged paragraph of a man page, such as the description of
+// an option: the tag, the text under it and the section it is in.
+type manItem struct {
+	section, tag, text string
+}
+
+// parseManPage returns the tagged paragraphs of a man page written with
+// the man macros, including those DocBook generates, or with mdoc.
+func parseManPage(src string) []manItem {
+	var (
+		items   []manItem
+		section string
+		// current is the item whose text is being read, or -1
+		current = -1
+		// tagNext is set when the next line is a tag, after .TP, and
+		// afterPP after a paragraph break, where DocBook puts a tag
+		// followed by an indented text
+		tagNext, afterPP, extraTag bool
+	)
+	addText := func(text string) {
+		switch {
+		case text == "":
+		case tagNext && extraTag && current >= 0:
+			items[current].tag += ", " + text
+			tagNext, extraTag = false, false
+		case tagNext:
+			items = append(items, manItem{section: section, tag: text})
+			current, tagNext = len(items)-1, false
+		case current >= 0:
+			items[current].text += " " + text
+		}
+	}
+
+	lines := strings.Split(src, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, ".") && !strings.HasPrefix(line, "'") {
+			if afterPP && i+1 < len(lines) && strings.HasPrefix(lines[i+1], ".RS") {
+				tagNext = true
+			}
+			afterPP = false
+			addText(manText(line))
+			continue
+		}
+
+		name, args, _ := strings.Cut(strings.TrimSpace(line[1:]), " ")
+		args = strings.TrimSpace(args)
+		switch name {
+		case "SH", "Sh":
+			section = strings.ToUpper(strings.Trim(manText(args), `"`))
+			current, tagNext = -1, false
+		case "SS", "Ss", "PP", "P", "LP", "Pp", "RE":
+			current, tagNext = -1, false
+			afterPP = name != "RE"
+		case "TP":
+			current, tagNext = -1, true
+		case "TQ":
+			tagNext, extraTag = true, true
+		case "IP":
+			current = -1
+			if tag := manText(firstArg(args)); tag != "" {
+				items = append(items, manItem{section: section, tag: tag})
+				current = len(items) - 1
+			}
+		case "It":
+			items = append(items, manItem{section: section, tag: mdocText(args)})
+			current = len(items) - 1
+		case "B", "I", "SM", "SB":
+			addText(manText(strings.Trim(args, `"`)))
+		case "BR", "RB", "BI", "IB", "IR", "RI":
+			addText(manText(strings.Join(splitArgs(args), "")))
+		default:
+			if isMdocMacro(name) {
+				addText(mdocText(name + " " + args))
+			}
+		}
+	}
+	return items
+}
+
+// firstArg returns the first argument of a request, unquoted.
+func firstArg(args string) string {
+	if fields := splitArgs(args); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
+// splitArgs splits the arguments of a request at spaces outside double
+// quotes.
+func splitArgs(args string) []string {
+	var (
+		fields []string
+		cur    strings.Builder
+		quoted bool
+		inArg  bool
+	)
+	for _, r := range args {
+		switch {
+		case r == '"':
+			quoted, inArg = !quoted, true
+		case r == ' ' && !quoted:
+			if inArg {
+				fields = append(fields, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		fields = append(fields, cur.String())
+	}
+	return fields
+}
+
+// manChars maps groff's named characters to text.
+var manChars = map[string]string{
+	"aq": "'", "oq": "'", "cq": "'", "lq": `"`, "rq": `"`, "dq": `"`,
+	"em": "-", "en": "-", "hy": "-", "mi": "-", "bu": "*", "ti": "~",
+	"ga": "`", "ha": "^", "rs": `\`, "Fo": "«", "Fc": "»",
+}
+
+// manText turns a line of groff text into plain text, dropping font
+// changes and comments and replacing escapes with what they stand for.
+func manText(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case '"':
+			return strings.TrimSpace(sb.String())
+		case 'f', 's', 'n', '*':
+			// A font, size, number register or string: \fB, \f(CW,
+			// \f[CR], \s-1, \*(lq
+			var name string
+			name, i = escapeName(s, i+1)
+			if c == '*' {
+				sb.WriteString(manChars[name])
+			}
+		case '(':
+			sb.WriteString(manChars[s[i+1:min(i+3, len(s))]])
+			i = min(i+2, len(s)-1)
+		case '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return sb.String()
+			}
+			sb.WriteString(manChars[s[i+1:i+end]])
+			i += end
+		case 'e', '\\':
+			sb.WriteByte('\\')
+		case '-', ' ', '.', '\'', '`':
+			sb.WriteByte(c)
+		case '&', ',', '/', '%', 'c', '|', '^', ':', ')':
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// escapeName reads the name of an escape such as \f or \*, which is one
+// character, or two after (, or anything in brackets, and a size's sign
+// and digits. It returns the name and the index of its last byte.
+func escapeName(s string, i int) (string, int) {
+	if i >= len(s) {
+		return "", len(s) - 1
+	}
+	switch s[i] {
+	case '(':
+		end := min(i+3, len(s))
+		return s[i+1 : end], end - 1
+	case '[':
+		end := strings.IndexByte(s[i:], ']')
+		if end < 0 {
+			return "", len(s) - 1
+		}
+		return s[i+1 : i+end], i + end
+	case '+', '-':
+		j := i + 1
+		for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			j++
+		}
+		return s[i:j], j - 1
+	}
+	j := i + 1
+	if s[i] >= '0' && s[i] <= '9' {
+		for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			j++
+		}
+	}
+	return s[i:j], j - 1
+}
+
+// isMdocMacro reports whether name is an mdoc macro that produces text.
+func isMdocMacro(name string) bool {
+	return len(name) == 2 && name[0] >= 'A' && name[0] <= 'Z' && name[1] >= 'a' && name[1] <= 'z' &&
+		!strings.Contains("Sh Ss Pp It Bl El Bd Ed Dd Dt Os Nd", name)
+}
+
+// mdocText turns the arguments of an mdoc line into plain text: Fl puts a
+// dash before the word after it, Op and Oo and Oc put brackets around
+// optional parts, and the names of other macros are dropped.
+func mdocText(args string) string {
+	var (
+		words  []string
+		dash   bool
+		attach bool
+		close  int
+	)
+	for _, word := range splitArgs(manText(args)) {
+		switch {
+		case word == "Fl":
+			dash = true
+			continue
+		case word == "Op" || word == "Oo":
+			words = append(words, "[")
+			attach = true
+			if word == "Op" {
+				close++
+			}
+			continue
+		case word == "Oc":
+			word = "]"
+		case word == "Ns":
+			attach = true
+			continue
+		case isMdocMacro(word):
+			continue
+		}
+		if dash {
+			word = "-" + word
+			dash = false
+		}
+		if attach || len(words) > 0 && strings.Contains(".,;:)]|", word) {
+			if len(words) > 0 {
+				words[len(words)-1] += word
+			} else {
+				words = append(words, word)
+			}
+			attach = false
+			continue
+		}
+		words = append(words, word)
+	}
+	if dash {
+		words = append(words, "-")
+	}
+	text := strings.Join(words, " ")
+	return text + strings.Repeat("]", close)
+}
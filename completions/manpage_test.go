@@ -0,0 +1,154 @@
+package completions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseManPage(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []manItem
+	}{
+		{
+			name: "man",
+			src: `.TH LS 1
+.SH NAME
+ls \- list directory contents
+.SH DESCRIPTION
+List information about the FILEs.
+.TP
+\fB\-a\fR, \fB\-\-all\fR
+do not ignore entries starting with .
+.TP
+.BR \-w ", " \-\-width =\fICOLS\fP
+set output width to COLS.
+0 means no limit
+.PP
+Exit status:
+.IP "\fB\-\-color\fR" 4
+colorize the output
+`,
+			want: []manItem{
+				{"DESCRIPTION", "-a, --all", " do not ignore entries starting with ."},
+				{"DESCRIPTION", "-w, --width=COLS", " set output width to COLS. 0 means no limit"},
+				{"DESCRIPTION", "--color", " colorize the output"},
+			},
+		},
+		{
+			name: "TQ",
+			src: `.SH OPTIONS
+.TP
+.B \-v
+.TQ
+.B \-\-verbose
+say more
+`,
+			want: []manItem{
+				{"OPTIONS", "-v, --verbose", " say more"},
+			},
+		},
+		{
+			name: "docbook",
+			src: `.SH "COMMANDS"
+.PP
+\fBadd\fR
+.RS 4
+Add file contents to the index\&.
+.RE
+.PP
+Some paragraph that is not a tag\&.
+`,
+			want: []manItem{
+				{"COMMANDS", "add", " Add file contents to the index."},
+			},
+		},
+		{
+			name: "mdoc",
+			src: `.Dd May 1, 2024
+.Sh DESCRIPTION
+.Bl -tag -width Ds
+.It Fl a
+Include entries starting with
+.Ql \&. .
+.It Fl o Ar file Op Fl f
+Write to
+.Ar file .
+.El
+`,
+			want: []manItem{
+				{"DESCRIPTION", "-a", " Include entries starting with .."},
+				{"DESCRIPTION", "-o file [-f]", " Write to file."},
+			},
+		},
+		{
+			name: "no tags",
+			src:  ".SH NAME\nfoo \\- do things\n.PP\nJust text.\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := parseManPage(tt.src); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseManPage = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestManText(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{`plain text`, "plain text"},
+		{`\fBbold\fR and \fIitalic\fP`, "bold and italic"},
+		{`\f(CWmono\f[CR] \f[B]x\fR`, "mono x"},
+		{`\-\-all`, "--all"},
+		{`\(em dash \[en] \(lqquoted\(rq`, `- dash - "quoted"`},
+		{`\*(lqstring\*(rq`, `"string"`},
+		{`\s-1SMALL\s0 text`, "SMALL text"},
+		{`a\&.b\|c`, "a.bc"},
+		{`back\eslash \\`, `back\slash \`},
+		{`text \" a comment`, "text"},
+		{`\[unknown]x`, "x"},
+	}
+	for _, tt := range tests {
+		if got := manText(tt.s); got != tt.want {
+			t.Errorf("manText(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		args string
+		want []string
+	}{
+		{`a b  c`, []string{"a", "b", "c"}},
+		{`"a b" c`, []string{"a b", "c"}},
+		{`\-w ", " \-\-width`, []string{`\-w`, ", ", `\-\-width`}},
+		{`""`, []string{""}},
+		{``, nil},
+	}
+	for _, tt := range tests {
+		if got := splitArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestMdocText(t *testing.T) {
+	tests := []struct {
+		args, want string
+	}{
+		{`Fl a`, "-a"},
+		{`Fl o Ar file`, "-o file"},
+		{`Op Fl v`, "[-v]"},
+		{`Fl f Oo Ar mode Oc`, "-f [mode]"},
+		{`Fl w Ns Ar width`, "-wwidth"},
+		{`Ar file ,`, "file,"},
+	}
+	for _, tt := range tests {
+		if got := mdocText(tt.args); got != tt.want {
+			t.Errorf("mdocText(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package completions
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"formalshell/expand"
+)
+
+// Spec is a completion specification in the manner of bash's complete and
+// compgen: the candidates named by its actions, word list, glob, function
+// and command, narrowed by its filter and then given its prefix and suffix.
+type Spec struct {
+	// Actions name sets of candidates, as for -A: "file", "directory",
+	// "command" and so on.
+	Actions []string
+	// Words is the word list given with -W, split at blanks.
+	Words []string
+	// Glob is the pattern given with -G; the files it matches are
+	// candidates.
+	Glob string
+	// Function and Command are run by Shell for their candidates, as for
+	// -F and -C.
+	Function string
+	Command  string
+	// Filter is the pattern given with -X. Candidates matching it are
+	// dropped, or with a leading ! those not matching it. An & in it stands
+	// for the word being completed.
+	Filter string
+	// Prefix and Suffix are added to each candidate, as for -P and -S.
+	Prefix, Suffix string
+	// Options are the names given with -o: nospace, filenames, dirnames,
+	// plusdirs, default and bashdefault.
+	Options []string
+	// Shell runs Function and Command.
+	Shell Shell
+}
+
+// Shell runs the parts of a Spec that belong to the shell.
+type Shell interface {
+	// CallFunction calls the completion function name as complete -F does.
+	CallFunction(name string, ctx *Context) []Candidate
+	// RunCommand runs command as complete -C does and returns the lines it
+	// prints.
+	RunCommand(command string, ctx *Context) []string
+}
+
+// actionFlags are the options that stand for an action.
+var actionFlags = map[byte]string{
+	'a': "alias", 'b': "builtin", 'c': "command", 'd': "directory",
+	'e': "export", 'f': "file", 'g': "group", 'k': "keyword",
+	'u': "user", 'v': "variable",
+}
+
+// actions maps action names to the completers that produce their
+// candidates.
+var actions = map[string]Completer{
+	"file":      Files,
+	"directory": Directories,
+	"user":      CompleterFunc(users),
+	"group":     CompleterFunc(groups),
+	"hostname":  CompleterFunc(hostnames),
+	"keyword":   CompleterFunc(keywords),
+	"signal":    CompleterFunc(signals),
+}
+
+// RegisterAction sets the completer for an action name, for the sets of
+// names, such as aliases or builtins, that only the shell knows.
+func RegisterAction(name string, c Completer) {
+	actions[name] = c
+}
+
+// ParseSpec parses the options of complete or compgen that make up a spec,
+// in getopt style, up to the first argument that isn't one or after "--".
+// The letters in other are accepted as options without an argument and
+// returned in flags. The arguments left over are returned in rest.
+func ParseSpec(args []string, other string) (spec *Spec, flags string, rest []string, err error) {
+	spec = &Spec{}
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for i := 1; i < len(arg); i++ {
+			c := arg[i]
+			if action, ok := actionFlags[c]; ok {
+				spec.Actions = append(spec.Actions, action)
+				continue
+			}
+			if strings.IndexByte(other, c) >= 0 {
+				flags += string(c)
+				continue
+			}
+			if strings.IndexByte("AoGWFCXPS", c) < 0 {
+				return nil, "", nil, fmt.Errorf("-%c: invalid option", c)
+			}
+
+			// The rest of the argument, or the next one, is the value
+			value := arg[i+1:]
+			if value == "" {
+				if len(args) == 0 {
+					return nil, "", nil, fmt.Errorf("-%c: option requires an argument", c)
+				}
+				value, args = args[0], args[1:]
+			}
+			if err := spec.set(c, value); err != nil {
+				return nil, "", nil, err
+			}
+			break
+		}
+	}
+	return spec, flags, args, nil
+}
+
+// set sets the field of the spec for option c.
+func (s *Spec) set(c byte, value string) error {
+	switch c {
+	case 'A':
+		if _, ok := actions[value]; !ok {
+			return fmt.Errorf("%s: invalid action name", value)
+		}
+		s.Actions = append(s.Actions, value)
+	case 'o':
+		switch value {
+		case "nospace", "filenames", "dirnames", "plusdirs", "default", "bashdefault", "noquote", "nosort":
+			s.Options = append(s.Options, value)
+		default:
+			return fmt.Errorf("%s: invalid option name", value)
+		}
+	case 'G':
+		s.Glob = value
+	case 'W':
+		s.Words = strings.Fields(value)
+	case 'F':
+		s.Function = value
+	case 'C':
+		s.Command = value
+	case 'X':
+		s.Filter = value
+	case 'P':
+		s.Prefix = value
+	case 'S':
+		s.Suffix = value
+	}
+	return nil
+}
+
+// Args returns the options that define the spec again, as complete -p
+// prints them.
+func (s *Spec) Args() []string {
+	var args []string
+	for _, option := range s.Options {
+		args = append(args, "-o", option)
+	}
+	for _, action := range s.Actions {
+		flag := ""
+		for c, name := range actionFlags {
+			if name == action {
+				flag = "-" + string(c)
+			}
+		}
+		if flag != "" {
+			args = append(args, flag)
+		} else {
+			args = append(args, "-A", action)
+		}
+	}
+	for _, option := range []struct{ flag, value string }{
+		{"-G", s.Glob},
+		{"-W", strings.Join(s.Words, " ")},
+		{"-X", s.Filter},
+		{"-P", s.Prefix},
+		{"-S", s.Suffix},
+		{"-F", s.Function},
+		{"-C", s.Command},
+	} {
+		if option.value != "" {
+			args = append(args, option.flag, option.value)
+		}
+	}
+	return args
+}
+
+// HasOption reports whether the spec was given option name with -o.
+func (s *Spec) HasOption(name string) bool {
+	for _, option := range s.Options {
+		if option == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Complete returns the candidates the spec produces for the word in ctx.
+// Unlike other completers it only returns candidates that start with the
+// word, as the filter, prefix and suffix apply to those.
+func (s *Spec) Complete(ctx *Context) []Candidate {
+	word := ctx.Word()
+	var candidates []Candidate
+	for _, action := range s.Actions {
+		if c, ok := actions[action]; ok {
+			candidates = append(candidates, c.Complete(ctx)...)
+		}
+	}
+	candidates = append(candidates, WordList(s.Words).Complete(ctx)...)
+	if s.Glob != "" {
+		for _, match := range expand.Glob(s.Glob) {
+			candidates = append(candidates, Candidate{Text: match})
+		}
+	}
+	if s.Function != "" && s.Shell != nil {
+		candidates = append(candidates, s.Shell.CallFunction(s.Function, ctx)...)
+	}
+	if s.Command != "" && s.Shell != nil {
+		for _, line := range s.Shell.RunCommand(s.Command, ctx) {
+			candidates = append(candidates, Candidate{Text: line})
+		}
+	}
+
+	matched := candidates[:0]
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate.Text, word) && !s.filtered(candidate.Text, word) {
+			matched = append(matched, candidate)
+		}
+	}
+	candidates = matched
+
+	if s.HasOption("plusdirs") {
+		candidates = append(candidates, Directories.Complete(ctx)...)
+	}
+	if len(candidates) == 0 {
+		switch {
+		case s.HasOption("dirnames"):
+			candidates = Directories.Complete(ctx)
+		case s.HasOption("default"), s.HasOption("bashdefault"):
+			candidates = Files.Complete(ctx)
+		}
+	}
+
+	for i := range candidates {
+		candidate := &candidates[i]
+		if s.HasOption("filenames") && candidate.File == nil {
+			markDirectory(candidate)
+		}
+		candidate.Text = s.Prefix + candidate.Text + s.Suffix
+		if s.HasOption("nospace") {
+			candidate.NoSpace = true
+		}
+	}
+	return candidates
+}
+
+// filtered reports whether the spec's filter drops text.
+func (s *Spec) filtered(text, word string) bool {
+	if s.Filter == "" {
+		return false
+	}
+	pattern, negate := s.Filter, false
+	if strings.HasPrefix(pattern, "!") {
+		pattern, negate = pattern[1:], true
+	}
+	pattern = strings.ReplaceAll(pattern, "&", word)
+	return expand.Match(pattern, text) != negate
+}
+
+// markDirectory treats a candidate that names a directory the way a path
+// candidate is: with a trailing slash, left open for more of the path.
+func markDirectory(candidate *Candidate) {
+	if strings.HasSuffix(candidate.Text, "/") {
+		candidate.NoSpace = true
+		return
+	}
+	info, err := os.Stat(expand.Tilde(candidate.Text))
+	if err == nil && info.IsDir() {
+		candidate.Text += "/"
+		candidate.NoSpace = true
+	}
+}
+
+// users completes user names from /etc/passwd.
+func users(*Context) []Candidate {
+	return namesFromFile("/etc/passwd", func(line string) []string {
+		name, _, _ := strings.Cut(line, ":")
+		return []string{name}
+	})
+}
+
+// groups completes group names from /etc/group.
+func groups(*Context) []Candidate {
+	return namesFromFile("/etc/group", func(line string) []string {
+		name, _, _ := strings.Cut(line, ":")
+		return []string{name}
+	})
+}
+
+// hostnames completes the host names in /etc/hosts.
+func hostnames(*Context) []Candidate {
+	return namesFromFile("/etc/hosts", func(line string) []string {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil
+		}
+		return fields[1:]
+	})
+}
+
+// namesFromFile returns the names parse finds in each line of file,
+// skipping comments.
+func namesFromFile(file string, parse func(line string) []string) []Candidate {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var candidates []Candidate
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, name := range parse(line) {
+			if name != "" {
+				candidates = append(candidates, Candidate{Text: name})
+			}
+		}
+	}
+	return candidates
+}
+
+// keywords completes the shell's reserved words.
+func keywords(*Context) []Candidate {
+	names := []string{"case", "for", "in", "function", "select", "time", "[[", "]]"}
+	for name := range commandKeywords {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return WordList(names).Complete(nil)
+}
+
+// signals completes signal names, as kill and trap take them.
+func signals(*Context) []Candidate {
+	return WordList{
+		"SIGHUP", "SIGINT", "SIGQUIT", "SIGILL", "SIGTRAP", "SIGABRT", "SIGBUS",
+		"SIGFPE", "SIGKILL", "SIGUSR1", "SIGSEGV", "SIGUSR2", "SIGPIPE", "SIGALRM",
+		"SIGTERM", "SIGCHLD", "SIGCONT", "SIGSTOP", "SIGTSTP", "SIGTTIN", "SIGTTOU",
+		"SIGURG", "SIGXCPU", "SIGXFSZ", "SIGVTALRM", "SIGPROF", "SIGWINCH", "SIGIO",
+		"SIGSYS",
+	}.Complete(nil)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"formalshell/cmds"
+	"formalshell/parser"
+)
+
+// configFile returns the path of the formalshell config.
+func configFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "formalshell", "config"), nil
+}
+
+// loadConfig runs the formalshell config in the shell itself, so the
+// aliases, functions, variables and key bindings it defines stay in effect.
+// A missing config is not an error.
+func (sh *shellState) loadConfig(stdio *cmds.IO) int {
+	path, err := configFile()
+	if err != nil {
+		return 0
+	}
+	status, err := sh.sourceFile(path, nil, stdio)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0
+	} else if err != nil {
+		fmt.Fprintf(stdio.Stderr, "formalshell: %v\n", err)
+		return 1
+	}
+	return status
+}
+
+// sourceFile runs the commands in the file at path in the current shell.
+// When args are given they become the positional parameters while it runs.
+// Aliases it defines are not saved, even at the prompt.
+func (sh *shellState) sourceFile(path string, args []string, stdio *cmds.IO) (int, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return 1, err
+	}
+
+	if args != nil {
+		savedArgs := sh.positional
+		sh.positional = args
+		defer func() { sh.positional = savedArgs }()
+	}
+	savedPersist := persistAliases
+	persistAliases = false
+	sh.sourceDepth++
+	defer func() {
+		persistAliases = savedPersist
+		sh.sourceDepth--
+	}()
+
+	status := sh.runSource(path, string(src), stdio)
+	if sh.pending.kind == jumpReturn {
+		sh.pending.kind = 0
+	}
+	return status, nil
+}
+
+// runSource runs src one complete command at a time, the way lines typed
+// at the prompt are run, so an alias defined on one line is expanded on the
+// following ones. Syntax errors are reported with the file name and line
+// and the rest of the file is still run.
+func (sh *shellState) runSource(name, src string, stdio *cmds.IO) int {
+	lines := strings.Split(src, "\n")
+	status := 0
+	for start := 0; start < len(lines) && sh.pending.kind == 0; {
+		end := start + 1
+		chunk := lines[start]
+		list, err := parser.ParseWithAliases(chunk, sh.lookupAlias)
+		for isIncomplete(err) && end < len(lines) {
+			chunk += "\n" + lines[end]
+			end++
+			list, err = parser.ParseWithAliases(chunk, sh.lookupAlias)
+		}
+
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "%s:%d: %v\n", name, start+1, err)
+			status = 2
+		} else {
+			status = sh.runList(list, stdio, fgJob)
+		}
+		start = end
+	}
+	return status
+}
+
+// sourceBuiltin implements `source FILE [ARG ...]` and `. FILE [ARG ...]`.
+func sourceBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stdio.Stderr, "source: filename argument required")
+		return 2
+	}
+	var fileArgs []string
+	if len(args) > 1 {
+		fileArgs = args[1:]
+	}
+	status, err := sh.sourceFile(args[0], fileArgs, stdio)
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "source: %v\n", err)
+		return 1
+	}
+	return status
+}
+
+// reloadConfigBuiltin implements `reload-config`, running the config again
+// after it has been edited.
+func reloadConfigBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	return sh.loadConfig(stdio)
+}
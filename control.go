@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"formalshell/cmds"
+	"formalshell/expand"
+	"formalshell/parser"
+	"formalshell/vars"
+)
+
+// maxFuncDepth limits function recursion so a runaway function fails
+// instead of crashing the shell.
+const maxFuncDepth = 1000
+
+// interruptStatus is the status of a command killed by Ctrl-C, which also
+// stops any loop running it.
+const interruptStatus = 130
+
+// jumpKind is the kind of a pending break, continue, return or exit.
+type jumpKind int
+
+const (
+	jumpBreak jumpKind = iota + 1
+	jumpContinue
+	jumpReturn
+	// jumpExit leaves a non-interactive shell, or the subshell it is
+	// pending in.
+	jumpExit
+)
+
+// shellState is what running commands changes in the shell besides its
+// variables: the functions defined so far, the positional parameters and
+// loops of the function being run, any break, continue or return in
+// progress, and $?. It is passed down to everything that runs commands.
+// Commands that run alongside the shell, such as completion functions, get
+// a copy of their own from subshell.
+type shellState struct {
+	// functions holds the shell functions defined so far.
+	functions map[string]*parser.FuncDecl
+	// positional holds the positional parameters, $1 onwards.
+	positional []string
+	// localFrames holds, for each function being run, the previous values
+	// of the variables it declared local, or nil for ones that were unset.
+	localFrames []map[string]*vars.Variable
+	// loopDepth is the number of loops running in the current function.
+	loopDepth int
+	// pending is a break, continue, return or exit in progress. Lists
+	// stop running while it is set, until the loop or function it leaves
+	// clears it; an exit is never cleared.
+	pending struct {
+		kind jumpKind
+		// count is how many enclosing loops a break or continue leaves.
+		count int
+		// status is the status an exit leaves with.
+		status int
+	}
+	// sourceDepth is the number of files being sourced, which lets
+	// `return` leave a sourced file early.
+	sourceDepth int
+	// lastStatus is the exit status of the most recent command, exposed
+	// as $?.
+	lastStatus int
+	// substStatus is the exit status of the most recent command
+	// substitution.
+	substStatus int
+	// inSubshell is set in a copy made by subshell, which `exit` leaves
+	// instead of the shell's process.
+	inSubshell bool
+}
+
+// mainShell is the state of the shell running the commands typed at the
+// prompt or read from a script. Only the code that reads commands, and
+// completes them, starts from it; everything else is handed a state.
+var mainShell = newShellState()
+
+func newShellState() *shellState {
+	return &shellState{functions: make(map[string]*parser.FuncDecl)}
+}
+
+// subshell returns a copy of the state for commands that run alongside the
+// shell. The functions, positional parameters, loops and $? are the same
+// to begin with, but nothing the copy does changes them in sh.
+func (sh *shellState) subshell() *shellState {
+	sub := &shellState{
+		functions:   maps.Clone(sh.functions),
+		positional:  slices.Clone(sh.positional),
+		localFrames: make([]map[string]*vars.Variable, len(sh.localFrames)),
+		loopDepth:   sh.loopDepth,
+		sourceDepth: sh.sourceDepth,
+		lastStatus:  sh.lastStatus,
+		inSubshell:  true,
+	}
+	// The variables in sh's frames are restored by sh; the copy only
+	// restores what it declares local itself
+	for i := range sub.localFrames {
+		sub.localFrames[i] = make(map[string]*vars.Variable)
+	}
+	return sub
+}
+
+// isCompound reports whether a pipeline is a single compound command,
+// which can't be run as one process group.
+func isCompound(pipeline *parser.Pipeline) bool {
+	if len(pipeline.Cmds) != 1 {
+		return false
+	}
+	_, simple := pipeline.Cmds[0].(*parser.SimpleCommand)
+	return !simple
+}
+
+// boolStatus converts a condition into an exit status.
+func boolStatus(ok bool) int {
+	if ok {
+		return 0
+	}
+	return 1
+}
+
+// runCompound runs a compound command, with its redirections applied, or
+// defines a function.
+func (sh *shellState) runCompound(cmd parser.Command, stdio *cmds.IO, mode jobMode) int {
+	if decl, ok := cmd.(*parser.FuncDecl); ok {
+		sh.functions[decl.Name] = decl
+		return 0
+	}
+
+	env := shellEnv{sh: sh, mode: mode}
+	var redirs []*parser.Redirect
+	switch c := cmd.(type) {
+	case *parser.IfClause:
+		redirs = c.Redirs
+	case *parser.WhileClause:
+		redirs = c.Redirs
+	case *parser.ForClause:
+		redirs = c.Redirs
+	case *parser.CaseClause:
+		redirs = c.Redirs
+	case *parser.Block:
+		redirs = c.Redirs
+	}
+	if len(redirs) > 0 {
+		redirected, closeFiles, err := applyRedirects(env, redirs, stdio)
+		if err != nil {
+			return sh.expandError(err, stdio)
+		}
+		defer closeFiles()
+		stdio = redirected
+	}
+
+	switch c := cmd.(type) {
+	case *parser.IfClause:
+		return sh.runIf(c, stdio, mode)
+	case *parser.WhileClause:
+		return sh.runWhile(c, stdio, mode)
+	case *parser.ForClause:
+		return sh.runFor(c, stdio, mode, env)
+	case *parser.CaseClause:
+		return sh.runCase(c, stdio, mode, env)
+	case *parser.Block:
+		return sh.runList(c.Body, stdio, mode)
+	}
+	return 0
+}
+
+func (sh *shellState) runIf(c *parser.IfClause, stdio *cmds.IO, mode jobMode) int {
+	cond := sh.runList(c.Cond, stdio, mode)
+	if sh.pending.kind != 0 {
+		return cond
+	}
+	if cond == 0 {
+		return sh.runList(c.Then, stdio, mode)
+	}
+	if c.Else != nil {
+		return sh.runList(c.Else, stdio, mode)
+	}
+	return 0
+}
+
+func (sh *shellState) runWhile(c *parser.WhileClause, stdio *cmds.IO, mode jobMode) int {
+	sh.loopDepth++
+	defer func() { sh.loopDepth-- }()
+
+	status := 0
+	for {
+		cond := sh.runList(c.Cond, stdio, mode)
+		if sh.loopDone() || cond == interruptStatus || (cond == 0) == c.Until {
+			break
+		}
+		status = sh.runList(c.Body, stdio, mode)
+		if sh.loopDone() || status == interruptStatus {
+			break
+		}
+	}
+	return status
+}
+
+func (sh *shellState) runFor(c *parser.ForClause, stdio *cmds.IO, mode jobMode, env shellEnv) int {
+	words := append([]string(nil), sh.positional...)
+	if c.HasIn {
+		var err error
+		if words, err = expand.Fields(env, c.Words...); err != nil {
+			return sh.expandError(err, stdio)
+		}
+	}
+
+	sh.loopDepth++
+	defer func() { sh.loopDepth-- }()
+
+	status := 0
+	for _, word := range words {
+		shellVars.Set(c.Name, word)
+		status = sh.runList(c.Body, stdio, mode)
+		if sh.loopDone() || status == interruptStatus {
+			break
+		}
+	}
+	return status
+}
+
+func (sh *shellState) runCase(c *parser.CaseClause, stdio *cmds.IO, mode jobMode, env shellEnv) int {
+	word, err := expand.Literal(env, c.Word)
+	if err != nil {
+		return sh.expandError(err, stdio)
+	}
+
+	for _, item := range c.Items {
+		for _, pattern := range item.Patterns {
+			pat, err := expand.Pattern(env, pattern)
+			if err != nil {
+				return sh.expandError(err, stdio)
+			}
+			if !expand.Match(pat, word) {
+				continue
+			}
+			if len(item.Body.Items) == 0 {
+				return 0
+			}
+			return sh.runList(item.Body, stdio, mode)
+		}
+	}
+	return 0
+}
+
+// loopDone handles a pending break or continue at the end of a loop
+// iteration, and reports whether the loop should stop.
+func (sh *shellState) loopDone() bool {
+	switch sh.pending.kind {
+	case 0:
+		return false
+	case jumpReturn, jumpExit:
+		return true
+	}
+
+	// Leave this loop on the way to an outer one
+	if sh.pending.count > 1 {
+		sh.pending.count--
+		return true
+	}
+	kind := sh.pending.kind
+	sh.pending.kind = 0
+	return kind == jumpBreak
+}
+
+// callFunction runs a shell function with args as its positional
+// parameters. Variables it declares local are restored when it returns.
+func (sh *shellState) callFunction(fn *parser.FuncDecl, args []string, stdio *cmds.IO, mode jobMode) int {
+	if len(sh.localFrames) >= maxFuncDepth {
+		fmt.Fprintf(stdio.Stderr, "%s: maximum function nesting level exceeded\n", fn.Name)
+		return 1
+	}
+
+	savedArgs, savedDepth := sh.positional, sh.loopDepth
+	sh.positional, sh.loopDepth = args, 0
+	sh.localFrames = append(sh.localFrames, make(map[string]*vars.Variable))
+	defer func() {
+		frame := sh.localFrames[len(sh.localFrames)-1]
+		sh.localFrames = sh.localFrames[:len(sh.localFrames)-1]
+		for name, prev := range frame {
+			restoreVar(name, prev)
+		}
+		sh.positional, sh.loopDepth = savedArgs, savedDepth
+	}()
+
+	status := sh.runCompound(fn.Body, stdio, mode)
+	if sh.pending.kind == jumpReturn {
+		sh.pending.kind = 0
+		status = sh.lastStatus
+	}
+	return status
+}
@@ -0,0 +1,210 @@
+package expand
+
+import (
+	"strconv"
+	"strings"
+
+	"formalshell/parser"
+)
+
+// braceItem is one element of a word during brace expansion: either an
+// unquoted character or an opaque quoted or expanded part.
+type braceItem struct {
+	r    rune
+	part parser.WordPart
+}
+
+func (it braceItem) is(r rune) bool {
+	return it.part == nil && it.r == r
+}
+
+// Braces performs brace expansion on a word, turning a{b,c}d into abd acd
+// and {1..3} into 1 2 3. Only unquoted braces are special, and a brace
+// pair without a comma or a valid sequence is kept as it is.
+func Braces(word *parser.Word) []*parser.Word {
+	var items []braceItem
+	for _, part := range word.Parts {
+		if lit, ok := part.(*parser.Lit); ok {
+			for _, r := range lit.Value {
+				items = append(items, braceItem{r: r})
+			}
+		} else {
+			items = append(items, braceItem{part: part})
+		}
+	}
+
+	expanded := expandBraces(items)
+	if len(expanded) == 1 {
+		return []*parser.Word{word}
+	}
+	words := make([]*parser.Word, len(expanded))
+	for i, items := range expanded {
+		words[i] = braceWord(items)
+	}
+	return words
+}
+
+// expandBraces expands the first valid brace expression and recurses on
+// each result, which handles both nesting and later expressions.
+func expandBraces(items []braceItem) [][]braceItem {
+	for open := range items {
+		if !items[open].is('{') {
+			continue
+		}
+		alternatives, close, ok := braceAlternatives(items, open)
+		if !ok {
+			continue
+		}
+
+		var results [][]braceItem
+		for _, alt := range alternatives {
+			combined := make([]braceItem, 0, open+len(alt)+len(items)-close)
+			combined = append(combined, items[:open]...)
+			combined = append(combined, alt...)
+			combined = append(combined, items[close+1:]...)
+			results = append(results, expandBraces(combined)...)
+		}
+		return results
+	}
+	return [][]braceItem{items}
+}
+
+// braceAlternatives parses the brace expression starting at open and
+// returns its alternatives and the index of the closing brace.
+func braceAlternatives(items []braceItem, open int) ([][]braceItem, int, bool) {
+	depth := 0
+	start := open + 1
+	var alternatives [][]braceItem
+	for i := open + 1; i < len(items); i++ {
+		switch {
+		case items[i].is('{'):
+			depth++
+		case items[i].is('}') && depth > 0:
+			depth--
+		case items[i].is(',') && depth == 0:
+			alternatives = append(alternatives, items[start:i])
+			start = i + 1
+		case items[i].is('}'):
+			if alternatives != nil {
+				return append(alternatives, items[start:i]), i, true
+			}
+			if seq, ok := braceSequence(items[open+1 : i]); ok {
+				return seq, i, true
+			}
+			return nil, 0, false
+		}
+	}
+	return nil, 0, false
+}
+
+// braceSequence expands the inside of {1..5}, {a..e} or {0..10..2}.
+func braceSequence(items []braceItem) ([][]braceItem, bool) {
+	var sb strings.Builder
+	for _, it := range items {
+		if it.part != nil {
+			return nil, false
+		}
+		sb.WriteRune(it.r)
+	}
+	bounds := strings.Split(sb.String(), "..")
+	if len(bounds) != 2 && len(bounds) != 3 {
+		return nil, false
+	}
+
+	step := 1
+	if len(bounds) == 3 {
+		n, err := strconv.Atoi(bounds[2])
+		if err != nil {
+			return nil, false
+		}
+		if step = n; step < 0 {
+			step = -step
+		} else if step == 0 {
+			step = 1
+		}
+	}
+
+	var values []string
+	if lo, err1 := strconv.Atoi(bounds[0]); err1 == nil {
+		hi, err := strconv.Atoi(bounds[1])
+		if err != nil {
+			return nil, false
+		}
+		// A leading zero on either bound pads every value to that width
+		width := 0
+		for _, b := range bounds[:2] {
+			if len(strings.TrimPrefix(b, "-")) > 1 && strings.HasPrefix(strings.TrimPrefix(b, "-"), "0") {
+				width = max(width, len(b))
+			}
+		}
+		for _, n := range sequence(lo, hi, step) {
+			s := strconv.Itoa(n)
+			for len(s) < width {
+				if n < 0 {
+					s = "-0" + s[1:]
+				} else {
+					s = "0" + s
+				}
+			}
+			values = append(values, s)
+		}
+	} else {
+		lo, hi := []rune(bounds[0]), []rune(bounds[1])
+		if len(lo) != 1 || len(hi) != 1 || !isLetter(lo[0]) || !isLetter(hi[0]) {
+			return nil, false
+		}
+		for _, n := range sequence(int(lo[0]), int(hi[0]), step) {
+			values = append(values, string(rune(n)))
+		}
+	}
+
+	alternatives := make([][]braceItem, len(values))
+	for i, v := range values {
+		for _, r := range v {
+			alternatives[i] = append(alternatives[i], braceItem{r: r})
+		}
+	}
+	return alternatives, true
+}
+
+// sequence counts from lo to hi in either direction.
+func sequence(lo, hi, step int) []int {
+	var values []int
+	if lo <= hi {
+		for n := lo; n <= hi; n += step {
+			values = append(values, n)
+		}
+	} else {
+		for n := lo; n >= hi; n -= step {
+			values = append(values, n)
+		}
+	}
+	return values
+}
+
+func isLetter(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+// braceWord joins items back into a word, merging runs of characters
+// into literals.
+func braceWord(items []braceItem) *parser.Word {
+	word := &parser.Word{}
+	var lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 {
+			word.Parts = append(word.Parts, &parser.Lit{Value: lit.String()})
+			lit.Reset()
+		}
+	}
+	for _, it := range items {
+		if it.part != nil {
+			flush()
+			word.Parts = append(word.Parts, it.part)
+		} else {
+			lit.WriteRune(it.r)
+		}
+	}
+	flush()
+	return word
+}
@@ -0,0 +1,369 @@
+// Package expand turns parsed words into the strings a command receives.
+// Expansion happens in the usual shell order: braces, tildes, parameters
+// and command substitutions, field splitting, pathname globbing and finally quote removal.
+package expand
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"formalshell/parser"
+)
+
+// Env gives expansion access to the shell's variables.
+type Env interface {
+	// Get returns the value of a variable or special parameter and
+	// whether it is set.
+	Get(name string) (string, bool)
+	// Set assigns a variable, as ${NAME:=word} does.
+	Set(name, value string)
+	// Subst runs the commands of a command substitution and returns
+	// their output.
+	Subst(list *parser.List) (string, error)
+	// Args returns the positional parameters, $1 onwards.
+	Args() []string
+}
+
+// defaultIFS separates fields when IFS is unset.
+const defaultIFS = " \t\n"
+
+// UnsetError is the error of ${NAME?word} when NAME is unset, which makes
+// a non-interactive shell exit.
+type UnsetError struct {
+	Name string
+	Msg  string
+}
+
+func (e *UnsetError) Error() string {
+	return e.Name + ": " + e.Msg
+}
+
+// Fields expands words into command arguments. The results of unquoted
+// expansions are split into separate fields on the characters of $IFS, and
+// fields containing unquoted glob characters are replaced by the matching
+// paths, if there are any.
+func Fields(env Env, words ...*parser.Word) ([]string, error) {
+	e := newExpander(env)
+	e.split = true
+
+	for _, word := range words {
+		for _, word := range Braces(word) {
+			if err := e.parts(e.tilde(word).Parts, false); err != nil {
+				return nil, err
+			}
+			e.endField()
+		}
+	}
+	return e.fields, nil
+}
+
+// Literal expands a word to a single string without brace expansion, field
+// splitting or globbing, as for redirection targets.
+func Literal(env Env, word *parser.Word) (string, error) {
+	if word == nil {
+		return "", nil
+	}
+	e := newExpander(env)
+	if err := e.parts(e.tilde(word).Parts, false); err != nil {
+		return "", err
+	}
+	return e.cur.String(), nil
+}
+
+// Assignment expands the value of a NAME=value assignment. It is like
+// Literal, except that a tilde is also expanded after each colon, as in
+// PATH=~/bin:~/go/bin.
+func Assignment(env Env, word *parser.Word) (string, error) {
+	if word == nil {
+		return "", nil
+	}
+	e := newExpander(env)
+	e.assign = true
+	if err := e.parts(e.tilde(word).Parts, false); err != nil {
+		return "", err
+	}
+	return e.cur.String(), nil
+}
+
+// Pattern expands a word for use as a pattern with Match. Quoted parts
+// are escaped so that they only match themselves.
+func Pattern(env Env, word *parser.Word) (string, error) {
+	if word == nil {
+		return "", nil
+	}
+	e := newExpander(env)
+	if err := e.parts(word.Parts, false); err != nil {
+		return "", err
+	}
+	return e.pat.String(), nil
+}
+
+type expander struct {
+	env Env
+	// split enables field splitting and globbing of unquoted text.
+	split bool
+	// assign expands tildes after colons as well as at the start.
+	assign bool
+	ifs    string
+
+	fields []string
+	// cur is the current field with quotes removed, and pat the same
+	// field as a pattern, with quoted characters escaped.
+	cur, pat strings.Builder
+	// keep is set when the current field must be produced even if it
+	// ends up empty, e.g. for "".
+	keep bool
+	// glob is set when the field contains unquoted glob characters.
+	glob bool
+}
+
+func newExpander(env Env) *expander {
+	e := &expander{env: env, ifs: defaultIFS}
+	if ifs, ok := env.Get("IFS"); ok {
+		e.ifs = ifs
+	}
+	return e
+}
+
+// endField finishes the current field.
+func (e *expander) endField() {
+	if e.glob {
+		if matches := Glob(e.pat.String()); len(matches) > 0 {
+			e.fields = append(e.fields, matches...)
+			e.reset()
+			return
+		}
+	}
+	if e.cur.Len() > 0 || e.keep {
+		e.fields = append(e.fields, e.cur.String())
+	}
+	e.reset()
+}
+
+func (e *expander) reset() {
+	e.cur.Reset()
+	e.pat.Reset()
+	e.keep = false
+	e.glob = false
+}
+
+// writeQuoted adds text that must be taken literally.
+func (e *expander) writeQuoted(s string) {
+	e.cur.WriteString(s)
+	e.pat.WriteString(escapePattern(s))
+	e.keep = true
+}
+
+// writeUnquoted adds unquoted text, which may act as a glob pattern.
+func (e *expander) writeUnquoted(s string) {
+	e.cur.WriteString(s)
+	e.pat.WriteString(s)
+	if e.split && strings.ContainsAny(s, "*?[") {
+		e.glob = true
+	}
+}
+
+// writeSplit adds the result of an unquoted expansion, splitting it into
+// fields on IFS.
+func (e *expander) writeSplit(s string) {
+	if !e.split {
+		e.writeUnquoted(s)
+		return
+	}
+
+	start := 0
+	for i, r := range s {
+		if !strings.ContainsRune(e.ifs, r) {
+			continue
+		}
+		e.writeUnquoted(s[start:i])
+		start = i + utf8.RuneLen(r)
+		if strings.ContainsRune(" \t\n", r) {
+			// Runs of IFS whitespace separate fields but never make
+			// empty ones
+			e.endField()
+		} else {
+			// Other IFS characters each end a field, even an empty one
+			e.keep = true
+			e.endField()
+		}
+	}
+	e.writeUnquoted(s[start:])
+}
+
+func (e *expander) parts(parts []parser.WordPart, quoted bool) error {
+	for _, part := range parts {
+		switch p := part.(type) {
+		case *parser.Lit:
+			if quoted {
+				e.writeQuoted(p.Value)
+			} else {
+				e.writeUnquoted(p.Value)
+			}
+		case *parser.SglQuoted:
+			e.writeQuoted(p.Value)
+		case *parser.DblQuoted:
+			if e.split && len(p.Parts) == 1 && isAllArgs(p.Parts[0]) && len(e.env.Args()) == 0 {
+				// "$@" without positional parameters makes no field at all
+				continue
+			}
+			e.keep = true
+			if err := e.parts(p.Parts, true); err != nil {
+				return err
+			}
+		case *parser.ParamExp:
+			if isAllArgs(p) && quoted && e.split {
+				// "$@" makes a separate field of each parameter
+				for i, arg := range e.env.Args() {
+					if i > 0 {
+						e.endField()
+					}
+					e.writeQuoted(arg)
+				}
+				continue
+			}
+			value, err := e.param(p)
+			if err != nil {
+				return err
+			}
+			if quoted {
+				e.writeQuoted(value)
+			} else {
+				e.writeSplit(value)
+			}
+		case *parser.CmdSubst:
+			out, err := e.env.Subst(p.List)
+			if err != nil {
+				return err
+			}
+			// Trailing newlines are dropped from the output
+			out = strings.TrimRight(out, "\n")
+			if quoted {
+				e.writeQuoted(out)
+			} else {
+				e.writeSplit(out)
+			}
+		}
+	}
+	return nil
+}
+
+// isAllArgs reports whether part is a plain $@.
+func isAllArgs(part parser.WordPart) bool {
+	p, ok := part.(*parser.ParamExp)
+	return ok && p.Name == "@" && p.Op == "" && !p.Length
+}
+
+// param evaluates a parameter expansion.
+func (e *expander) param(p *parser.ParamExp) (string, error) {
+	value, set := e.env.Get(p.Name)
+	if p.Name == "*" && e.ifs != defaultIFS {
+		// $* joins the parameters with the first character of IFS
+		sep := ""
+		if e.ifs != "" {
+			sep = e.ifs[:utf8.RuneLen([]rune(e.ifs)[0])]
+		}
+		value = strings.Join(e.env.Args(), sep)
+	}
+	if p.Length {
+		return strconv.Itoa(utf8.RuneCountInString(value)), nil
+	}
+
+	// With a colon, an empty value counts as unset
+	missing := !set || strings.HasPrefix(p.Op, ":") && value == ""
+
+	switch strings.TrimPrefix(p.Op, ":") {
+	case "":
+		return value, nil
+	case "-":
+		if missing {
+			return Literal(e.env, p.Arg)
+		}
+	case "=":
+		if missing {
+			if !parser.IsName(p.Name) {
+				return "", fmt.Errorf("$%s: cannot assign in this way", p.Name)
+			}
+			arg, err := Literal(e.env, p.Arg)
+			if err != nil {
+				return "", err
+			}
+			e.env.Set(p.Name, arg)
+			return arg, nil
+		}
+	case "+":
+		if missing {
+			return "", nil
+		}
+		return Literal(e.env, p.Arg)
+	case "?":
+		if missing {
+			msg, err := Literal(e.env, p.Arg)
+			if err != nil {
+				return "", err
+			}
+			if msg == "" {
+				msg = "parameter null or not set"
+			}
+			return "", &UnsetError{Name: p.Name, Msg: msg}
+		}
+	case "#", "##", "%", "%%":
+		pattern, err := Pattern(e.env, p.Arg)
+		if err != nil {
+			return "", err
+		}
+		return trim(value, pattern, p.Op), nil
+	}
+	return value, nil
+}
+
+// trim removes the shortest (# and %) or longest (## and %%) prefix or
+// suffix of value that matches pattern.
+func trim(value, pattern, op string) string {
+	runes := []rune(value)
+	n := len(runes)
+	switch op {
+	case "#":
+		for i := 0; i <= n; i++ {
+			if Match(pattern, string(runes[:i])) {
+				return string(runes[i:])
+			}
+		}
+	case "##":
+		for i := n; i >= 0; i-- {
+			if Match(pattern, string(runes[:i])) {
+				return string(runes[i:])
+			}
+		}
+	case "%":
+		for i := n; i >= 0; i-- {
+			if Match(pattern, string(runes[i:])) {
+				return string(runes[:i])
+			}
+		}
+	case "%%":
+		for i := 0; i <= n; i++ {
+			if Match(pattern, string(runes[i:])) {
+				return string(runes[:i])
+			}
+		}
+	}
+	return value
+}
+
+// escapePattern backslash-escapes the characters Match treats specially.
+func escapePattern(s string) string {
+	if !strings.ContainsAny(s, `*?[\`) {
+		return s
+	}
+	var sb strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[\`, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
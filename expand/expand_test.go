@@ -0,0 +1,295 @@
+package expand
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"formalshell/parser"
+)
+
+// testEnv is an Env with fixed variables and arguments, which $@ and $*
+// join with spaces as the shell does. Command substitutions only run echo.
+type testEnv struct {
+	vars map[string]string
+	args []string
+}
+
+func newTestEnv() *testEnv {
+	return &testEnv{
+		vars: map[string]string{
+			"HOME":  "/home/u",
+			"x":     "a b",
+			"empty": "",
+			"file":  "main.tar.gz",
+			"path":  "/usr/local/bin",
+			"star":  "*",
+		},
+		args: []string{"one", "two three"},
+	}
+}
+
+func (e *testEnv) Get(name string) (string, bool) {
+	if name == "@" || name == "*" {
+		return strings.Join(e.args, " "), true
+	}
+	value, ok := e.vars[name]
+	return value, ok
+}
+
+func (e *testEnv) Set(name, value string) {
+	e.vars[name] = value
+}
+
+func (e *testEnv) Subst(list *parser.List) (string, error) {
+	var out []string
+	for _, andOr := range list.Items {
+		cmd := andOr.Pipelines[0].Cmds[0].(*parser.SimpleCommand)
+		args, err := Fields(e, cmd.Args...)
+		if err != nil {
+			return "", err
+		}
+		if len(args) > 0 && args[0] == "echo" {
+			out = append(out, strings.Join(args[1:], " ")+"\n")
+		}
+	}
+	return strings.Join(out, ""), nil
+}
+
+func (e *testEnv) Args() []string {
+	return e.args
+}
+
+// parseWords returns the words of the simple command in src.
+func parseWords(t *testing.T, src string) []*parser.Word {
+	t.Helper()
+	list, err := parser.Parse(src)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", src, err)
+	}
+	return list.Items[0].Pipelines[0].Cmds[0].(*parser.SimpleCommand).Args
+}
+
+func TestFields(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{`plain words`, []string{"plain", "words"}},
+		{`$x`, []string{"a", "b"}},
+		{`"$x"`, []string{"a b"}},
+		{`'$x'`, []string{"$x"}},
+		{`\$x`, []string{"$x"}},
+		{`pre$x"post"`, []string{"prea", "bpost"}},
+		{`$empty`, nil},
+		{`"$empty"`, []string{""}},
+		{`''`, []string{""}},
+		{`$unset`, nil},
+		{`${x}y`, []string{"a", "by"}},
+		{`${unset:-def}`, []string{"def"}},
+		{`${empty-def}`, nil},
+		{`${empty:-def}`, []string{"def"}},
+		{`${x:+alt}`, []string{"alt"}},
+		{`${unset+alt}`, nil},
+		{`${#x}`, []string{"3"}},
+		{`${file%.*}`, []string{"main.tar"}},
+		{`${file%%.*}`, []string{"main"}},
+		{`${path#*/}`, []string{"usr/local/bin"}},
+		{`${path##*/}`, []string{"bin"}},
+		{`${file%"*"}`, []string{"main.tar.gz"}},
+		{`$@`, []string{"one", "two", "three"}},
+		{`"$@"`, []string{"one", "two three"}},
+		{`"$*"`, []string{"one two three"}},
+		{`"$star"`, []string{"*"}},
+		{`a{b,c}d`, []string{"abd", "acd"}},
+		{`{1..3}`, []string{"1", "2", "3"}},
+		{`{a}`, []string{"{a}"}},
+		{`"{a,b}"`, []string{"{a,b}"}},
+		{`~`, []string{"/home/u"}},
+		{`~/src`, []string{"/home/u/src"}},
+		{`"~"`, []string{"~"}},
+		{`a~`, []string{"a~"}},
+		{`$(echo hi there)`, []string{"hi", "there"}},
+		{`"$(echo hi there)"`, []string{"hi there"}},
+		{"`echo $x`", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		got, err := Fields(newTestEnv(), parseWords(t, "cmd "+tt.src)[1:]...)
+		if err != nil {
+			t.Errorf("Fields(%s): %v", tt.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Fields(%s) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestFieldsIFS(t *testing.T) {
+	env := newTestEnv()
+	env.vars["IFS"] = ":"
+	env.vars["list"] = "a:b::c"
+	got, err := Fields(env, parseWords(t, `cmd $list "$*"`)[1:]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "b", "", "c", "one:two three"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Fields with IFS=: = %q, want %q", got, want)
+	}
+}
+
+func TestUnsetError(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`${unset?}`, "unset: parameter null or not set"},
+		{`${unset?gone $x}`, "unset: gone a b"},
+		{`${empty:?must be set}`, "empty: must be set"},
+	}
+	for _, tt := range tests {
+		_, err := Literal(newTestEnv(), parseWords(t, "cmd "+tt.src)[1])
+		var unset *UnsetError
+		if !errors.As(err, &unset) {
+			t.Errorf("Literal(%s) error = %v, want an UnsetError", tt.src, err)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("Literal(%s) error = %q, want %q", tt.src, err, tt.want)
+		}
+	}
+
+	if got, err := Literal(newTestEnv(), parseWords(t, `cmd ${empty?unused}`)[1]); err != nil || got != "" {
+		t.Errorf("Literal(${empty?unused}) = %q, %v, want no error", got, err)
+	}
+}
+
+func TestAssignment(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`P=~/bin:~/go/bin`, "/home/u/bin:/home/u/go/bin"},
+		{`P=a:~`, "a:/home/u"},
+		{`P=$x`, "a b"},
+		{`P="~"`, "~"},
+	}
+	for _, tt := range tests {
+		list, err := parser.Parse(tt.src)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.src, err)
+		}
+		assign := list.Items[0].Pipelines[0].Cmds[0].(*parser.SimpleCommand).Assigns[0]
+		got, err := Assignment(newTestEnv(), assign.Value)
+		if err != nil || got != tt.want {
+			t.Errorf("Assignment(%s) = %q, %v, want %q", tt.src, got, err, tt.want)
+		}
+	}
+}
+
+func TestAssignDefault(t *testing.T) {
+	env := newTestEnv()
+	got, err := Literal(env, parseWords(t, `cmd ${new:=value}`)[1])
+	if err != nil || got != "value" {
+		t.Errorf("Literal(${new:=value}) = %q, %v, want value", got, err)
+	}
+	if env.vars["new"] != "value" {
+		t.Errorf("${new:=value} left new = %q, want value", env.vars["new"])
+	}
+	if _, err := Literal(env, parseWords(t, `cmd ${1:=value}`)[1]); err == nil {
+		t.Errorf("Literal(${1:=value}) succeeded, want an error")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*", "anything", true},
+		{"*", "", true},
+		{"*.go", "main.go", true},
+		{"*.go", "main.c", false},
+		{"*/x", "a/b/x", true},
+		{"?", "a", true},
+		{"?", "ab", false},
+		{"a?c", "abc", true},
+		{"[abc]x", "bx", true},
+		{"[abc]x", "dx", false},
+		{"[a-c]", "b", true},
+		{"[!a-c]", "b", false},
+		{"[!a-c]", "d", true},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"é?", "éa", true},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPattern(t *testing.T) {
+	tests := []struct {
+		src, name string
+		want      bool
+	}{
+		{`*.go`, "x.go", true},
+		{`"*".go`, "x.go", false},
+		{`"*".go`, "*.go", true},
+		{`$star`, "anything", true},
+		{`"$star"`, "anything", false},
+	}
+	for _, tt := range tests {
+		pattern, err := Pattern(newTestEnv(), parseWords(t, "cmd "+tt.src)[1])
+		if err != nil {
+			t.Errorf("Pattern(%s): %v", tt.src, err)
+			continue
+		}
+		if got := Match(pattern, tt.name); got != tt.want {
+			t.Errorf("Match(Pattern(%s), %q) = %v, want %v", tt.src, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.go", "c.txt", ".hidden.go", "sub/d.go", "sub/deep/e.go"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"*.go", []string{"a.go", "b.go"}},
+		{".*.go", []string{".hidden.go"}},
+		{"?.txt", []string{"c.txt"}},
+		{"*/*.go", []string{"sub/d.go"}},
+		{"**/*.go", []string{"a.go", "b.go", "sub/d.go", "sub/deep/e.go"}},
+		{"*/", []string{"sub/"}},
+		{"*.none", nil},
+	}
+	for _, tt := range tests {
+		var want []string
+		for _, name := range tt.want {
+			want = append(want, dir+"/"+name)
+		}
+		if got := Glob(dir + "/" + tt.pattern); !reflect.DeepEqual(got, want) {
+			t.Errorf("Glob(%q) = %q, want %q", tt.pattern, got, want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package expand
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// HasMeta reports whether a pattern contains an unescaped *, ? or [.
+func HasMeta(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// unescape removes the backslashes that quote characters in a pattern.
+func unescape(pattern string) string {
+	if !strings.Contains(pattern, `\`) {
+		return pattern
+	}
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		sb.WriteByte(pattern[i])
+	}
+	return sb.String()
+}
+
+// Glob returns the sorted paths matching a pattern. Each path component is
+// matched separately, so * never crosses a slash, and a component of ** on
+// its own matches any number of directories. Names starting with a dot
+// only match a component that starts with a literal dot.
+func Glob(pattern string) []string {
+	paths := []string{""}
+	if strings.HasPrefix(pattern, "/") {
+		paths = []string{"/"}
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+
+	components := strings.Split(pattern, "/")
+	for i, component := range components {
+		last := i == len(components)-1
+		var next []string
+		for _, base := range paths {
+			switch {
+			case component == "":
+				// A trailing slash only matches directories
+				if info, err := os.Stat(dirOf(base)); err == nil && info.IsDir() && base != "" {
+					next = append(next, base+"/")
+				}
+			case component == "**":
+				next = append(next, globRecursive(base, last)...)
+			case !HasMeta(component):
+				path := joinPath(base, unescape(component))
+				if _, err := os.Lstat(path); err == nil {
+					next = append(next, path)
+				}
+			default:
+				next = append(next, globDir(base, component)...)
+			}
+		}
+		paths = next
+		if len(paths) == 0 {
+			return nil
+		}
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+// globDir matches one pattern component against the entries of base.
+func globDir(base, component string) []string {
+	entries, err := os.ReadDir(dirOf(base))
+	if err != nil {
+		return nil
+	}
+	var matches []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(component, ".") {
+			continue
+		}
+		if Match(component, name) {
+			matches = append(matches, joinPath(base, name))
+		}
+	}
+	return matches
+}
+
+// globRecursive returns base and every directory below it, skipping hidden
+// ones. When ** ends the pattern, files are included too.
+func globRecursive(base string, includeFiles bool) []string {
+	root := dirOf(base)
+	var matches []string
+	if !includeFiles {
+		matches = append(matches, base)
+	}
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || includeFiles {
+			rel, _ := filepath.Rel(root, path)
+			matches = append(matches, joinPath(base, filepath.ToSlash(rel)))
+		}
+		return nil
+	})
+	return matches
+}
+
+// dirOf returns the directory to read for a partial path, where "" stands
+// for the working directory.
+func dirOf(base string) string {
+	if base == "" {
+		return "."
+	}
+	return base
+}
+
+func joinPath(base, name string) string {
+	if base == "" || strings.HasSuffix(base, "/") {
+		return base + name
+	}
+	return base + "/" + name
+}
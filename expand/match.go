@@ -0,0 +1,96 @@
+package expand
+
+// Match reports whether name matches the shell pattern. A * matches any
+// string, ? any single character, [...] one character from a class, and a
+// backslash makes the next character literal. Unlike filepath.Match, * also
+// matches '/'.
+func Match(pattern, name string) bool {
+	p, s := []rune(pattern), []rune(name)
+	px, sx := 0, 0
+	// Where to resume after a mismatch following the last *
+	starPx, starSx := -1, -1
+
+	for px < len(p) || sx < len(s) {
+		if px < len(p) {
+			if p[px] == '*' {
+				starPx, starSx = px, sx
+				px++
+				continue
+			}
+			if sx < len(s) {
+				if ok, width := matchOne(p[px:], s[sx]); ok {
+					px += width
+					sx++
+					continue
+				}
+			}
+		}
+		// Let the last * swallow one more character and try again
+		if starPx >= 0 && starSx < len(s) {
+			starSx++
+			px, sx = starPx+1, starSx
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// matchOne matches the single pattern element at the start of p against r,
+// returning whether it matched and how many pattern runes it used.
+func matchOne(p []rune, r rune) (bool, int) {
+	switch p[0] {
+	case '?':
+		return true, 1
+	case '[':
+		if matched, width, ok := matchClass(p, r); ok {
+			return matched, width
+		}
+		// An unterminated [ is an ordinary character
+		return r == '[', 1
+	case '\\':
+		if len(p) > 1 {
+			return p[1] == r, 2
+		}
+	}
+	return p[0] == r, 1
+}
+
+// matchClass matches a bracket expression such as [a-z] or [!0-9] at the
+// start of p. ok is false if the expression is not terminated.
+func matchClass(p []rune, r rune) (matched bool, width int, ok bool) {
+	i := 1
+	negate := false
+	if i < len(p) && (p[i] == '!' || p[i] == '^') {
+		negate = true
+		i++
+	}
+
+	first := true
+	for i < len(p) {
+		if p[i] == ']' && !first {
+			return matched != negate, i + 1, true
+		}
+		first = false
+
+		lo := p[i]
+		if lo == '\\' && i+1 < len(p) {
+			i++
+			lo = p[i]
+		}
+		hi := lo
+		if i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']' {
+			hi = p[i+2]
+			if hi == '\\' && i+3 < len(p) {
+				i++
+				hi = p[i+2]
+			}
+			i += 2
+		}
+		if lo <= r && r <= hi {
+			matched = true
+		}
+		i++
+	}
+	return false, 0, false
+}
@@ -0,0 +1,142 @@
+package expand
+
+import (
+	"os"
+	"os/user"
+	"strings"
+
+	"formalshell/parser"
+)
+
+// Tilde expands a leading ~ or ~user in a plain path, for callers such as
+// completion that work on text rather than parsed words. The path is
+// returned unchanged if the home directory can't be found.
+func Tilde(path string) string {
+	if !strings.HasPrefix(path, "~") {
+		return path
+	}
+	name, rest, _ := strings.Cut(path[1:], "/")
+	home, ok := homeDir(nil, name)
+	if !ok {
+		return path
+	}
+	if rest == "" && !strings.Contains(path, "/") {
+		return home
+	}
+	return strings.TrimSuffix(home, "/") + "/" + rest
+}
+
+// homeDir resolves a tilde prefix: "" is $HOME, + is the working directory,
+// - is $OLDPWD and anything else is a user name. env may be nil.
+func homeDir(env Env, name string) (string, bool) {
+	lookup := func(key string) (string, bool) {
+		if env != nil {
+			return env.Get(key)
+		}
+		return os.LookupEnv(key)
+	}
+
+	switch name {
+	case "":
+		if home, ok := lookup("HOME"); ok && home != "" {
+			return home, true
+		}
+		home, err := os.UserHomeDir()
+		return home, err == nil
+	case "+":
+		if wd, err := os.Getwd(); err == nil {
+			return wd, true
+		}
+		return lookup("PWD")
+	case "-":
+		return lookup("OLDPWD")
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", false
+	}
+	return u.HomeDir, true
+}
+
+// tilde replaces tilde prefixes in a word with the directory they name.
+// A tilde is only special at the start of the word or, in assignments,
+// after an unquoted colon, and the prefix must not contain quoted text.
+func (e *expander) tilde(word *parser.Word) *parser.Word {
+	out := &parser.Word{}
+	for i, part := range word.Parts {
+		lit, ok := part.(*parser.Lit)
+		if !ok || !(i == 0 || e.assign) {
+			out.Parts = append(out.Parts, part)
+			continue
+		}
+
+		// The character before this literal decides whether a tilde at its
+		// start may be expanded
+		atStart := i == 0
+		if i > 0 {
+			prev, ok := word.Parts[i-1].(*parser.Lit)
+			atStart = ok && strings.HasSuffix(prev.Value, ":")
+		}
+		lastPart := i == len(word.Parts)-1
+
+		var pending strings.Builder
+		flush := func() {
+			if pending.Len() > 0 {
+				out.Parts = append(out.Parts, &parser.Lit{Value: pending.String()})
+				pending.Reset()
+			}
+		}
+
+		value := lit.Value
+		for {
+			if atStart {
+				if home, rest, ok := e.tildePrefix(value, lastPart); ok {
+					flush()
+					out.Parts = append(out.Parts, &parser.SglQuoted{Value: home})
+					value = rest
+				}
+			}
+			if !e.assign {
+				break
+			}
+			k := strings.IndexByte(value, ':')
+			if k < 0 {
+				break
+			}
+			pending.WriteString(value[:k+1])
+			value = value[k+1:]
+			atStart = true
+		}
+		pending.WriteString(value)
+		flush()
+	}
+	return out
+}
+
+// tildePrefix expands a tilde prefix at the start of s, returning the
+// directory and the text after the prefix. lastPart reports whether s ends
+// the word; if not, a prefix running to the end of s continues into quoted
+// text and is left alone.
+func (e *expander) tildePrefix(s string, lastPart bool) (string, string, bool) {
+	if !strings.HasPrefix(s, "~") {
+		return "", "", false
+	}
+	terminators := "/"
+	if e.assign {
+		terminators = "/:"
+	}
+
+	end := strings.IndexAny(s, terminators)
+	if end < 0 {
+		if !lastPart {
+			return "", "", false
+		}
+		end = len(s)
+	}
+	home, ok := homeDir(e.env, s[1:end])
+	if !ok {
+		return "", "", false
+	}
+	return home, s[end:], true
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"formalshell/cmds"
+	"formalshell/expand"
+	"formalshell/history"
+	"github.com/chzyer/readline"
+)
+
+var (
+	// shellHistory is the command history of an interactive shell, or nil
+	// when running a script.
+	shellHistory *history.History
+	// historyInSubshell is set in a subshell of an interactive shell,
+	// which loads shellHistory from $HISTFILE when it is first needed. As
+	// in bash, the subshell's history is a copy: clearing it or deleting
+	// entries leaves the file alone.
+	historyInSubshell bool
+	// lineEditor reads the interactive shell's input, or is nil when
+	// running a script.
+	lineEditor *readline.Instance
+)
+
+// historyBuiltin implements
+//
+//	history [-v] [--here | --dir DIR] [--status N | --failed] [N | PATTERN]
+//	history -c
+//	history -d N
+//
+// Listing shows each entry with the number !N refers to. N limits it to the
+// last N entries and PATTERN to commands containing it. --here and --dir
+// keep commands run in a directory, and --status and --failed filter on exit
+// status. -v adds when, where and how each command ran. -c clears the
+// history and -d deletes entry N, or the Nth from the end when negative.
+func historyBuiltin(sh *shellState, stdio *cmds.IO, args []string) int {
+	if shellHistory == nil && historyInSubshell {
+		histFile, _ := shellVars.Get("HISTFILE")
+		if hist, err := history.New(histFile); err == nil {
+			hist.Options = historyOptions()
+			if err := hist.Load(); err == nil {
+				hist.HistoryFile = ""
+				shellHistory = hist
+			}
+		}
+	}
+	hist := shellHistory
+	if hist == nil {
+		fmt.Fprintln(stdio.Stderr, "history: no history in a non-interactive shell")
+		return 1
+	}
+
+	var (
+		verbose bool
+		dir     string
+		status  = -1
+		failed  bool
+		limit   int
+		pattern string
+	)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "-c":
+			err := hist.Clear()
+			if lineEditor != nil {
+				loadReadlineHistory(lineEditor, hist)
+			}
+			if err != nil {
+				fmt.Fprintf(stdio.Stderr, "history: %v\n", err)
+				return 1
+			}
+			return 0
+		case "-d":
+			if i+1 >= len(args) {
+				fmt.Fprintln(stdio.Stderr, "history: -d: option requires an argument")
+				return 2
+			}
+			return deleteHistory(stdio, hist, args[i+1])
+		case "-v":
+			verbose = true
+		case "--here":
+			wd, err := os.Getwd()
+			if err != nil {
+				fmt.Fprintf(stdio.Stderr, "history: %v\n", err)
+				return 1
+			}
+			dir = wd
+		case "--dir":
+			if i+1 >= len(args) {
+				fmt.Fprintln(stdio.Stderr, "history: --dir: option requires an argument")
+				return 2
+			}
+			i++
+			abs, err := filepath.Abs(expand.Tilde(args[i]))
+			if err != nil {
+				fmt.Fprintf(stdio.Stderr, "history: %v\n", err)
+				return 1
+			}
+			dir = abs
+		case "--status":
+			if i+1 >= len(args) {
+				fmt.Fprintln(stdio.Stderr, "history: --status: option requires an argument")
+				return 2
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil {
+				fmt.Fprintf(stdio.Stderr, "history: %s: numeric argument required\n", args[i])
+				return 2
+			}
+			status = n
+		case "--failed":
+			failed = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				fmt.Fprintf(stdio.Stderr, "history: %s: invalid option\n", arg)
+				return 2
+			}
+			if n, err := strconv.Atoi(arg); err == nil {
+				limit = n
+			} else {
+				pattern = arg
+			}
+		}
+	}
+
+	// Filter first, so N counts the entries that match
+	var matches []int
+	for i, entry := range hist.Entries {
+		switch {
+		case dir != "" && entry.Dir != dir:
+		case status >= 0 && entry.Status != status:
+		case failed && entry.Status == 0:
+		case pattern != "" && !strings.Contains(entry.Command, pattern):
+		default:
+			matches = append(matches, i)
+		}
+	}
+	if limit > 0 && limit < len(matches) {
+		matches = matches[len(matches)-limit:]
+	}
+
+	for _, i := range matches {
+		entry := hist.Entries[i]
+		if !verbose {
+			fmt.Fprintf(stdio.Stdout, "%5d  %s\n", i+1, entry.Command)
+			continue
+		}
+		when := "-"
+		if !entry.Time.IsZero() {
+			when = entry.Time.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(stdio.Stdout, "%5d  %-16s  %3d  %8s  %s  %s\n", i+1, when, entry.Status,
+			entry.Duration.Round(time.Millisecond), entry.Dir, entry.Command)
+	}
+	return 0
+}
+
+// deleteHistory implements `history -d N`.
+func deleteHistory(stdio *cmds.IO, hist *history.History, arg string) int {
+	n, err := strconv.Atoi(arg)
+	index := n - 1
+	if n < 0 {
+		index = len(hist.Entries) + n
+	}
+	if err != nil || index < 0 || index >= len(hist.Entries) {
+		fmt.Fprintf(stdio.Stderr, "history: %s: history position out of range\n", arg)
+		return 1
+	}
+	err = hist.Delete(index)
+	if lineEditor != nil {
+		loadReadlineHistory(lineEditor, hist)
+	}
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "history: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,161 @@
+package history
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Expand performs bash-style history expansion on a line of input: !! is
+// the previous command, !N entry N, !-N the Nth command back, !prefix the
+// last command starting with prefix and !$ the last word of the previous
+// command. A line of the form ^old^new repeats the previous command with
+// old replaced by new. Nothing is expanded inside single quotes or after a
+// backslash. It reports whether the line changed.
+func (h *History) Expand(line string) (string, bool, error) {
+	if strings.HasPrefix(line, "^") {
+		return h.substitute(line)
+	}
+	if !strings.Contains(line, "!") {
+		return line, false, nil
+	}
+
+	var sb strings.Builder
+	changed := false
+	inSingle, inDouble := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && !inSingle && i+1 < len(line):
+			sb.WriteByte(c)
+			i++
+			sb.WriteByte(line[i])
+			continue
+		case c == '\'' && !inDouble:
+			inSingle = !inSingle
+		case c == '"' && !inSingle:
+			inDouble = !inDouble
+		case c == '!' && !inSingle && isEvent(line, i):
+			text, n, err := h.event(line[i+1:])
+			if err != nil {
+				return line, false, err
+			}
+			sb.WriteString(text)
+			i += n
+			changed = true
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String(), changed, nil
+}
+
+// isEvent reports whether the ! at line[i] starts an event designator.
+// Like bash, a ! before a blank, =, ( or the end of the line is left alone,
+// as are $! and ${!name}.
+func isEvent(line string, i int) bool {
+	if i+1 >= len(line) || strings.IndexByte(" \t\n=(\"", line[i+1]) >= 0 {
+		return false
+	}
+	return i == 0 || (line[i-1] != '$' && line[i-1] != '{')
+}
+
+// event expands the designator following a !, returning its text and how
+// many bytes of designator it used.
+func (h *History) event(spec string) (string, int, error) {
+	if len(h.Entries) == 0 {
+		return "", 0, fmt.Errorf("!%s: event not found", eventWord(spec))
+	}
+	last := h.Entries[len(h.Entries)-1].Command
+
+	switch spec[0] {
+	case '!':
+		return last, 1, nil
+	case '$':
+		words := Words(last)
+		if len(words) == 0 {
+			return "", 1, nil
+		}
+		return words[len(words)-1], 1, nil
+	}
+
+	word := eventWord(spec)
+	if n, err := strconv.Atoi(word); err == nil {
+		index := n - 1
+		if n < 0 {
+			index = len(h.Entries) + n
+		}
+		if index < 0 || index >= len(h.Entries) {
+			return "", 0, fmt.Errorf("!%s: event not found", word)
+		}
+		return h.Entries[index].Command, len(word), nil
+	}
+
+	for i := len(h.Entries) - 1; i >= 0; i-- {
+		if strings.HasPrefix(h.Entries[i].Command, word) {
+			return h.Entries[i].Command, len(word), nil
+		}
+	}
+	return "", 0, fmt.Errorf("!%s: event not found", word)
+}
+
+// eventWord returns the designator at the start of spec, which runs up to
+// the next blank, quote or shell operator.
+func eventWord(spec string) string {
+	if end := strings.IndexAny(spec, " \t\n'\";&|()<>"); end >= 0 {
+		return spec[:end]
+	}
+	return spec
+}
+
+// substitute handles ^old^new, replacing the first old in the previous
+// command.
+func (h *History) substitute(line string) (string, bool, error) {
+	parts := strings.SplitN(line[1:], "^", 3)
+	if len(parts) < 2 || parts[0] == "" {
+		return line, false, fmt.Errorf("%s: bad substitution", line)
+	}
+	if len(h.Entries) == 0 {
+		return line, false, fmt.Errorf("%s: event not found", line)
+	}
+	last := h.Entries[len(h.Entries)-1].Command
+	if !strings.Contains(last, parts[0]) {
+		return line, false, fmt.Errorf("%s: substitution failed", line)
+	}
+	expanded := strings.Replace(last, parts[0], parts[1], 1)
+	if len(parts) == 3 {
+		expanded += parts[2]
+	}
+	return expanded, true, nil
+}
+
+// Words splits a command into its words the way history expansion sees
+// them: at unquoted blanks, with quotes left in place.
+func Words(command string) []string {
+	var words []string
+	var cur strings.Builder
+	inSingle, inDouble, escaped := false, false, false
+	for _, r := range command {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && !inSingle:
+			escaped = true
+		case r == '\'' && !inDouble:
+			inSingle = !inSingle
+		case r == '"' && !inSingle:
+			inDouble = !inDouble
+		case (r == ' ' || r == '\t' || r == '\n') && !inSingle && !inDouble:
+			if cur.Len() > 0 {
+				words = append(words, cur.String())
+				cur.Reset()
+			}
+			continue
+		}
+		cur.WriteRune(r)
+	}
+	if cur.Len() > 0 {
+		words = append(words, cur.String())
+	}
+	return words
+}
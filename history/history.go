@@ -1,21 +1,106 @@
+// Package history keeps the shell's command history: an ordered log of
+// entries recording when, where and how each command ran. The history file
+// is append-only, one JSON object per line, so it stays in the order the
+// commands were run. Several shells can share one file: every access holds
+// a lock on a file next to it, and each shell appends only its own entries.
 package history
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
-
-	"github.com/chzyer/readline"
+	"syscall"
+	"time"
 )
 
+// DefaultSize is the number of entries kept when no size is configured.
+const DefaultSize = 10000
+
+// Entry is a single command in the history.
+type Entry struct {
+	Command string
+	// Time is when the command was started. It is zero for entries read
+	// from a history file written by older versions.
+	Time     time.Time
+	Dir      string
+	Status   int
+	Duration time.Duration
+}
+
+// fileEntry is the form an Entry takes in the history file.
+type fileEntry struct {
+	Command  string `json:"cmd"`
+	Time     int64  `json:"time,omitempty"`
+	Dir      string `json:"dir,omitempty"`
+	Status   int    `json:"status"`
+	Duration int64  `json:"ms"`
+}
+
+// Options controls which commands are kept.
+type Options struct {
+	// Size is the most entries kept, or DefaultSize when zero.
+	Size int
+	// IgnoreDups skips a command that repeats the one before it.
+	IgnoreDups bool
+	// EraseDups removes earlier copies of a command when it is added.
+	EraseDups bool
+	// IgnoreSpace skips commands that start with a space.
+	IgnoreSpace bool
+	// Share picks up the commands other shells append to the history
+	// file, as well as writing this shell's own.
+	Share bool
+}
+
+// ParseControl reads a bash-style HISTCONTROL value, a colon-separated
+// list of ignoredups, erasedups, ignorespace and ignoreboth, into opts.
+func ParseControl(opts *Options, control string) {
+	for _, item := range strings.Split(control, ":") {
+		switch item {
+		case "ignoredups":
+			opts.IgnoreDups = true
+		case "erasedups":
+			opts.EraseDups = true
+		case "ignorespace":
+			opts.IgnoreSpace = true
+		case "ignoreboth":
+			opts.IgnoreDups = true
+			opts.IgnoreSpace = true
+		}
+	}
+}
+
+// History is the command history, oldest entry first.
 type History struct {
-	CommandHistory map[string]bool
-	HistoryFile   string
+	Entries     []Entry
+	HistoryFile string
+	Options     Options
+	// fileLines counts the entries in the history file, including ones
+	// since dropped from Entries, so it can be compacted once it grows
+	// well past the size limit.
+	fileLines int
+	// offset is how much of the history file has been read, and info
+	// identifies the file it was read from, so that Sync can read on from
+	// there and notice when another shell has rewritten the file.
+	offset int64
+	info   os.FileInfo
 }
 
-func New() (*History, error) {
-	h := &History{
-		CommandHistory: make(map[string]bool),
+// New returns a History kept in file, or in ~/.config/formalshell/history
+// when file is empty.
+func New(file string) (*History, error) {
+	h := &History{}
+
+	if file != "" {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return nil, err
+		}
+		h.HistoryFile = file
+		return h, nil
 	}
 
 	homeDir, err := os.UserHomeDir()
@@ -29,40 +114,392 @@ func New() (*History, error) {
 	return h, nil
 }
 
-func (h *History) Load(rl *readline.Instance) error {
+// Limit returns the most entries to keep.
+func (o Options) Limit() int {
+	if o.Size > 0 {
+		return o.Size
+	}
+	return DefaultSize
+}
+
+// lock takes a lock on the history's lock file, shared or exclusive as
+// given by how, and returns a function that releases it.
+func (h *History) lock(how int) (func(), error) {
+	file, err := os.OpenFile(h.HistoryFile+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// Load reads the history file, applying the dedup options and size limit
+// to what it finds. Entries appended by different shells are merged in the
+// order they were started. Lines written by older versions, which held
+// only the command, are read as entries without a time and come first.
+func (h *History) Load() error {
 	if h.HistoryFile == "" {
 		return nil
 	}
+	unlock, err := h.lock(syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return h.load()
+}
+
+// load reads the whole history file into Entries. The lock must be held.
+func (h *History) load() error {
+	h.Entries = h.Entries[:0]
+	h.fileLines, h.offset, h.info = 0, 0, nil
+
+	entries, err := h.readNew()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	for _, entry := range entries {
+		h.insert(entry)
+	}
+	return nil
+}
 
-	data, err := os.ReadFile(h.HistoryFile)
+// readNew returns the entries added to the history file since it was last
+// read, and moves offset past them. Only whole lines are read, so an entry
+// still being written is left for next time. The lock must be held.
+func (h *History) readNew() ([]Entry, error) {
+	file, err := os.Open(h.HistoryFile)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	h.info = info
+	if _, err := file.Seek(h.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if end := bytes.LastIndexByte(data, '\n'); end >= 0 {
+		data = data[:end+1]
+	} else {
+		data = nil
+	}
+	h.offset += int64(len(data))
+
+	var entries []Entry
+	for _, line := range strings.Split(string(data), "\n") {
+		if entry, ok := parseLine(line); ok {
+			entries = append(entries, entry)
+			h.fileLines++
+		}
+	}
+	return entries, nil
+}
+
+// rewritten reports whether the history file has been replaced or cut
+// short since it was read, which another shell does when compacting it.
+func (h *History) rewritten() bool {
+	info, err := os.Stat(h.HistoryFile)
+	if err != nil || h.info == nil {
+		return err == nil
+	}
+	return !os.SameFile(info, h.info) || info.Size() < h.offset
+}
+
+// Sync picks up the entries other shells have added to the history file
+// since it was last read. It reports whether Entries changed.
+func (h *History) Sync() (bool, error) {
+	if h.HistoryFile == "" {
+		return false, nil
+	}
+	unlock, err := h.lock(syscall.LOCK_SH)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if h.rewritten() {
+		return true, h.load()
+	}
+	entries, err := h.readNew()
+	changed := false
+	for _, entry := range entries {
+		if h.insert(entry) {
+			changed = true
 		}
+	}
+	return changed, err
+}
+
+// parseLine reads one line of the history file.
+func parseLine(line string) (Entry, bool) {
+	if strings.TrimSpace(line) == "" {
+		return Entry{}, false
+	}
+
+	if !strings.HasPrefix(line, "{") {
+		return Entry{Command: strings.TrimSpace(line)}, true
+	}
+	// Skip anything that isn't a whole entry rather than reading garbage
+	// into the history
+	var fe fileEntry
+	if json.Unmarshal([]byte(line), &fe) != nil {
+		return Entry{}, false
+	}
+	entry := Entry{
+		Command:  fe.Command,
+		Dir:      fe.Dir,
+		Status:   fe.Status,
+		Duration: time.Duration(fe.Duration) * time.Millisecond,
+	}
+	if fe.Time != 0 {
+		entry.Time = time.Unix(fe.Time, 0)
+	}
+	return entry, entry.Command != ""
+}
+
+// formatLine writes an entry as a line of the history file, without the
+// trailing newline.
+func formatLine(entry Entry) ([]byte, error) {
+	fe := fileEntry{
+		Command:  entry.Command,
+		Dir:      entry.Dir,
+		Status:   entry.Status,
+		Duration: entry.Duration.Milliseconds(),
+	}
+	if !entry.Time.IsZero() {
+		fe.Time = entry.Time.Unix()
+	}
+	return json.Marshal(fe)
+}
+
+// insert adds an entry to Entries, applying the dedup options and size
+// limit. It reports whether the entry was kept.
+func (h *History) insert(entry Entry) bool {
+	if h.Options.IgnoreDups && len(h.Entries) > 0 && h.Entries[len(h.Entries)-1].Command == entry.Command {
+		return false
+	}
+	if h.Options.EraseDups {
+		kept := h.Entries[:0]
+		for _, e := range h.Entries {
+			if e.Command != entry.Command {
+				kept = append(kept, e)
+			}
+		}
+		h.Entries = kept
+	}
+
+	h.Entries = append(h.Entries, entry)
+	if extra := len(h.Entries) - h.Options.Limit(); extra > 0 {
+		h.Entries = append(h.Entries[:0], h.Entries[extra:]...)
+	}
+	return true
+}
+
+// Add records a command that has finished running and appends it to the
+// history file. It reports whether the entry was kept, which it isn't when
+// the dedup options say to skip it. With Share set, entries other shells
+// have appended are picked up first, so they come before this one.
+func (h *History) Add(entry Entry) (bool, error) {
+	if h.Options.IgnoreSpace && strings.HasPrefix(entry.Command, " ") {
+		return false, nil
+	}
+	entry.Command = strings.TrimSpace(entry.Command)
+	if entry.Command == "" {
+		return false, nil
+	}
+	if h.HistoryFile == "" {
+		return h.insert(entry), nil
+	}
+
+	unlock, err := h.lock(syscall.LOCK_EX)
+	if err != nil {
+		return h.insert(entry), err
+	}
+	defer unlock()
+
+	if h.Options.Share {
+		if h.rewritten() {
+			err = h.load()
+		} else {
+			var entries []Entry
+			entries, err = h.readNew()
+			for _, e := range entries {
+				h.insert(e)
+			}
+		}
+		if err != nil {
+			return h.insert(entry), err
+		}
+	}
+	if !h.insert(entry) {
+		return false, nil
+	}
+
+	line, err := formatLine(entry)
+	if err != nil {
+		return true, err
+	}
+	file, err := os.OpenFile(h.HistoryFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return true, err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return true, err
+	}
+	h.fileLines++
+
+	// Without sharing, what other shells wrote is skipped over
+	if info, err := file.Stat(); err == nil {
+		h.offset, h.info = info.Size(), info
+	}
+
+	// Rewrite the file once it holds far more than is kept, so it doesn't
+	// grow without bound
+	if h.fileLines >= 2*h.Options.Limit() {
+		return true, h.compact()
+	}
+	return true, nil
+}
+
+// compact rewrites the history file with only the entries it would load,
+// keeping those other shells have added. The lock must be held.
+func (h *History) compact() error {
+	merged := &History{HistoryFile: h.HistoryFile, Options: h.Options}
+	if err := merged.load(); err != nil {
 		return err
 	}
+	if err := merged.write(); err != nil {
+		return err
+	}
+	h.fileLines, h.offset, h.info = merged.fileLines, merged.offset, merged.info
+	return nil
+}
 
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		if line = strings.TrimSpace(line); line != "" {
-			rl.SaveHistory(line)
-			h.CommandHistory[line] = true
+// Delete removes the entry at index i from Entries and from the history
+// file, leaving what other shells have added in place.
+func (h *History) Delete(i int) error {
+	target := h.Entries[i]
+	h.Entries = append(h.Entries[:i], h.Entries[i+1:]...)
+	if h.HistoryFile == "" {
+		return nil
+	}
+
+	unlock, err := h.lock(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	merged := &History{HistoryFile: h.HistoryFile, Options: h.Options}
+	if err := merged.load(); err != nil {
+		return err
+	}
+	// The file keeps times to the second, so they are compared that way
+	for j := len(merged.Entries) - 1; j >= 0; j-- {
+		if e := merged.Entries[j]; e.Command == target.Command && e.Time.Unix() == target.Time.Unix() {
+			merged.Entries = append(merged.Entries[:j], merged.Entries[j+1:]...)
+			break
 		}
 	}
+	if err := merged.write(); err != nil {
+		return err
+	}
+	h.fileLines, h.offset, h.info = merged.fileLines, merged.offset, merged.info
 	return nil
 }
 
+// Clear removes every entry, emptying the history file.
+func (h *History) Clear() error {
+	h.Entries = nil
+	return h.Save()
+}
+
+// Save rewrites the history file from Entries, dropping anything other
+// shells have added that isn't in them.
 func (h *History) Save() error {
 	if h.HistoryFile == "" {
 		return nil
 	}
+	unlock, err := h.lock(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return h.write()
+}
 
-	var lines []string
-	for cmd := range h.CommandHistory {
-		if cmd = strings.TrimSpace(cmd); cmd != "" {
-			lines = append(lines, cmd)
+// write replaces the history file with Entries. The new file replaces the
+// old one in a single rename, so a crash can't leave it half written. The
+// lock must be held.
+func (h *History) write() error {
+	tmp, err := os.CreateTemp(filepath.Dir(h.HistoryFile), ".history_*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, entry := range h.Entries {
+		line, err := formatLine(entry)
+		if err != nil {
+			tmp.Close()
+			return err
 		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
 	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), h.HistoryFile); err != nil {
+		return err
+	}
+	h.fileLines, h.offset, h.info = len(h.Entries), info.Size(), info
+	return nil
+}
 
-	return os.WriteFile(h.HistoryFile, []byte(strings.Join(lines, "\n")+"\n"), 0666)
+// Commands returns each distinct command once, most recently used last.
+func (h *History) Commands() []string {
+	seen := make(map[string]bool, len(h.Entries))
+	commands := make([]string, 0, len(h.Entries))
+	for i := len(h.Entries) - 1; i >= 0; i-- {
+		if command := h.Entries[i].Command; !seen[command] {
+			seen[command] = true
+			commands = append(commands, command)
+		}
+	}
+	for i, j := 0, len(commands)-1; i < j; i, j = i+1, j-1 {
+		commands[i], commands[j] = commands[j], commands[i]
+	}
+	return commands
 }
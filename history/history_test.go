@@ -0,0 +1,183 @@
+package history
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newHistory returns a History kept in a file of its own with commands
+// added to it, each a little over a second after the one before.
+func newHistory(t *testing.T, commands ...string) *History {
+	t.Helper()
+	h, err := New(filepath.Join(t.TempDir(), "history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	for i, command := range commands {
+		entry := Entry{Command: command, Time: start.Add(time.Duration(i) * 1100 * time.Millisecond)}
+		if _, err := h.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+// reload reads the history file of h afresh.
+func reload(t *testing.T, h *History) *History {
+	t.Helper()
+	loaded := &History{HistoryFile: h.HistoryFile, Options: h.Options}
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return loaded
+}
+
+// commands returns the command of each entry, oldest first.
+func commands(h *History) []string {
+	var commands []string
+	for _, entry := range h.Entries {
+		commands = append(commands, entry.Command)
+	}
+	return commands
+}
+
+func TestDelete(t *testing.T) {
+	tests := []struct {
+		commands []string
+		delete   int
+		want     []string
+	}{
+		{[]string{"a", "b", "c"}, 0, []string{"b", "c"}},
+		{[]string{"a", "b", "c"}, 1, []string{"a", "c"}},
+		{[]string{"a", "b", "c"}, 2, []string{"a", "b"}},
+		{[]string{"a", "b", "a", "c"}, 2, []string{"a", "b", "c"}},
+		{[]string{"a", "b", "a", "c"}, 0, []string{"b", "a", "c"}},
+		{[]string{"only"}, 0, nil},
+	}
+	for _, tt := range tests {
+		h := newHistory(t, tt.commands...)
+		if err := h.Delete(tt.delete); err != nil {
+			t.Errorf("%q: Delete(%d): %v", tt.commands, tt.delete, err)
+			continue
+		}
+		if got := commands(h); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: Delete(%d) left %q, want %q", tt.commands, tt.delete, got, tt.want)
+		}
+		// The file only keeps whole seconds, which must still identify
+		// the entry
+		if got := commands(reload(t, h)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: Delete(%d) left %q in the file, want %q", tt.commands, tt.delete, got, tt.want)
+		}
+	}
+}
+
+func TestDeleteKeepsOtherShells(t *testing.T) {
+	h := newHistory(t, "a", "b")
+	other := reload(t, h)
+	if _, err := other.Add(Entry{Command: "from other", Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Delete(0); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"b", "from other"}
+	if got := commands(reload(t, h)); !reflect.DeepEqual(got, want) {
+		t.Errorf("file holds %q, want %q", got, want)
+	}
+}
+
+func TestAddOptions(t *testing.T) {
+	tests := []struct {
+		options  Options
+		commands []string
+		want     []string
+	}{
+		{Options{}, []string{"a", "a", "b"}, []string{"a", "a", "b"}},
+		{Options{IgnoreDups: true}, []string{"a", "a", "b", "a"}, []string{"a", "b", "a"}},
+		{Options{EraseDups: true}, []string{"a", "b", "a"}, []string{"b", "a"}},
+		{Options{IgnoreSpace: true}, []string{"a", " secret", "b"}, []string{"a", "b"}},
+		{Options{Size: 2}, []string{"a", "b", "c"}, []string{"b", "c"}},
+		{Options{}, []string{"  padded  ", "", "   "}, []string{"padded"}},
+	}
+	for _, tt := range tests {
+		h := &History{Options: tt.options}
+		for _, command := range tt.commands {
+			h.Add(Entry{Command: command})
+		}
+		if got := commands(h); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: adding %q kept %q, want %q", tt.options, tt.commands, got, tt.want)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	h := &History{}
+	for _, command := range []string{"git status", "make test", "echo 'a b' c", "ls -l /tmp"} {
+		h.Add(Entry{Command: command})
+	}
+
+	tests := []struct {
+		line    string
+		want    string
+		changed bool
+		err     bool
+	}{
+		{"echo plain", "echo plain", false, false},
+		{"!!", "ls -l /tmp", true, false},
+		{"sudo !!", "sudo ls -l /tmp", true, false},
+		{"cd !$", "cd /tmp", true, false},
+		{"!1", "git status", true, false},
+		{"!-2", "echo 'a b' c", true, false},
+		{"!mak", "make test", true, false},
+		{"!git && !ma", "git status && make test", true, false},
+		{"echo '!!'", "echo '!!'", false, false},
+		{`echo \!!`, `echo \!!`, false, false},
+		{`echo "!!"`, `echo "ls -l /tmp"`, true, false},
+		{"echo hi!", "echo hi!", false, false},
+		{"echo $! ${!x}", "echo $! ${!x}", false, false},
+		{"[ ! -f x ]", "[ ! -f x ]", false, false},
+		{"^-l^-la", "ls -la /tmp", true, false},
+		{"^tmp^var^/log", "ls -l /var/log", true, false},
+		{"!nope", "", false, true},
+		{"!99", "", false, true},
+		{"^zzz^y", "", false, true},
+	}
+	for _, tt := range tests {
+		got, changed, err := h.Expand(tt.line)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Expand(%q) = %q, want an error", tt.line, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want || changed != tt.changed {
+			t.Errorf("Expand(%q) = %q, %v, %v, want %q, %v", tt.line, got, changed, err, tt.want, tt.changed)
+		}
+	}
+
+	if _, _, err := (&History{}).Expand("!!"); err == nil {
+		t.Errorf("Expand(!!) with no history succeeded, want an error")
+	}
+}
+
+func TestWords(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"ls -l /tmp", []string{"ls", "-l", "/tmp"}},
+		{"  spaced   out  ", []string{"spaced", "out"}},
+		{"echo 'a b' \"c d\"", []string{"echo", "'a b'", `"c d"`}},
+		{`echo a\ b`, []string{"echo", `a\ b`}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := Words(tt.command); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Words(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
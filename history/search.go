@@ -0,0 +1,152 @@
+package history
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Match is a distinct command found by Search.
+type Match struct {
+	// Entry is the most recent run of the command.
+	Entry
+	// Count is how many times the command was run.
+	Count int
+	// Positions are the indexes of the runes of the command that matched
+	// the query, for highlighting.
+	Positions []int
+	Score     float64
+}
+
+// Search returns the distinct commands that contain the runes of query in
+// order, best first. Matches are ranked by how closely the command matches,
+// then by how recently and how often it was run. With an empty query every
+// command matches. When dir isn't empty, only commands run in dir count.
+func (h *History) Search(query, dir string) []Match {
+	byCommand := make(map[string]*Match)
+	lastRun := make(map[*Match]int)
+	var order []*Match
+	for i, entry := range h.Entries {
+		if dir != "" && entry.Dir != dir {
+			continue
+		}
+		m, ok := byCommand[entry.Command]
+		if !ok {
+			m = &Match{}
+			byCommand[entry.Command] = m
+			order = append(order, m)
+		}
+		m.Entry = entry
+		m.Count++
+		lastRun[m] = i
+	}
+
+	total := float64(len(h.Entries))
+	matches := make([]Match, 0, len(order))
+	for _, m := range order {
+		score, positions, ok := fuzzyMatch(query, m.Command)
+		if !ok {
+			continue
+		}
+		// Recency is relative to the newest entry, so that it weighs the
+		// same however long the history is
+		recency := 1 - (total-1-float64(lastRun[m]))/total
+		m.Positions = positions
+		m.Score = float64(score) + 20*recency + 6*math.Log2(float64(m.Count)+1)
+		matches = append(matches, *m)
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+	return matches
+}
+
+// fuzzyMatch reports whether the runes of query appear in text in order,
+// scoring the match: runs of consecutive runes and runes at the start of a
+// word score higher, and gaps cost a little. The match is case-insensitive
+// unless query has an upper case letter.
+func fuzzyMatch(query, text string) (int, []int, bool) {
+	if query == "" {
+		return 0, nil, true
+	}
+	fold := strings.ToLower(query) == query
+	q := []rune(query)
+	t := []rune(text)
+	if fold {
+		t = []rune(strings.ToLower(text))
+	}
+
+	// Try each place the first rune appears and keep the best
+	bestScore, found := 0, false
+	var best []int
+	for start := range t {
+		if t[start] != q[0] {
+			continue
+		}
+		score, positions, ok := matchFrom(q, t, start)
+		if ok && (!found || score > bestScore) {
+			bestScore, best, found = score, positions, true
+		}
+	}
+	return bestScore, best, found
+}
+
+// matchFrom greedily matches q against t from start, which matches q[0].
+func matchFrom(q, t []rune, start int) (int, []int, bool) {
+	positions := make([]int, 0, len(q))
+	score := 0
+	j := start
+	for i, r := range q {
+		for j < len(t) && t[j] != r {
+			j++
+		}
+		if j == len(t) {
+			return 0, nil, false
+		}
+		score += 16
+		if j == 0 || isWordStart(t[j-1]) {
+			score += 10
+		}
+		if i > 0 {
+			if gap := j - positions[i-1] - 1; gap == 0 {
+				score += 8
+			} else {
+				score -= min(gap, 8)
+			}
+		}
+		positions = append(positions, j)
+		j++
+	}
+	return score, positions, true
+}
+
+// isWordStart reports whether a rune following r starts a word.
+func isWordStart(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune("/-_.;|&=", r)
+}
+
+// Suggest returns the most recent command that starts with prefix and is
+// longer than it, to offer as the rest of a line being typed. A command run
+// in dir wins over one run elsewhere, however much newer. Commands spanning
+// several lines are left out.
+func (h *History) Suggest(prefix, dir string) (string, bool) {
+	if prefix == "" {
+		return "", false
+	}
+	fallback := ""
+	for i := len(h.Entries) - 1; i >= 0; i-- {
+		entry := h.Entries[i]
+		if len(entry.Command) <= len(prefix) || !strings.HasPrefix(entry.Command, prefix) ||
+			strings.Contains(entry.Command, "\n") {
+			continue
+		}
+		if entry.Dir == dir {
+			return entry.Command, true
+		}
+		if fallback == "" {
+			fallback = entry.Command
+		}
+	}
+	return fallback, fallback != ""
+}
@@ -0,0 +1,600 @@
+// Package jobs implements job control: running commands in their own
+// process groups, handing them the terminal, and keeping track of
+// background and stopped jobs.
+package jobs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/chzyer/readline"
+)
+
+// State is the run state of a job.
+type State int
+
+const (
+	Running State = iota
+	Stopped
+	Done
+)
+
+// process is a single process belonging to a job.
+type process struct {
+	cmd     *exec.Cmd
+	pid     int
+	status  int
+	done    bool
+	stopped bool
+}
+
+// Job is the set of processes started for one pipeline. When job control
+// is enabled they share a process group of their own.
+type Job struct {
+	ID   int
+	Text string
+
+	pgid  int
+	procs []*process
+	// control is set when the job has its own process group and can be
+	// handed the terminal.
+	control    bool
+	foreground bool
+	// changed is set when the job stopped or finished in the background
+	// and has not been reported yet.
+	changed  bool
+	disowned bool
+	// modes holds the terminal settings the job had when it was stopped.
+	modes *readline.State
+	// seq orders jobs by when they were last started or stopped, which
+	// decides the current (%+) and previous (%-) jobs.
+	seq int
+}
+
+var (
+	// Enabled reports whether job control is active. It is only turned on
+	// for interactive shells attached to a terminal.
+	Enabled bool
+	// LastPid is the process ID of the most recent background job, as $!.
+	LastPid int
+
+	ttyFd      int
+	shellPgid  int
+	shellModes *readline.State
+
+	mu          sync.Mutex
+	cond        = sync.NewCond(&mu)
+	table       []*Job
+	lastSeq     int
+	interrupted bool
+)
+
+// Init starts reaping background jobs. When interactive is set and stdin is
+// a terminal, it also moves the shell into its own process group in the
+// foreground and enables job control.
+func Init(interactive bool) {
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	go func() {
+		for range sigchld {
+			poll()
+		}
+	}()
+
+	ttyFd = int(os.Stdin.Fd())
+	if !interactive || !readline.IsTerminal(ttyFd) {
+		return
+	}
+
+	// Wait until we are in the foreground before taking over the terminal
+	for {
+		pgid, err := tcgetpgrp(ttyFd)
+		if err != nil {
+			return
+		}
+		if pgid == syscall.Getpgrp() {
+			break
+		}
+		syscall.Kill(-syscall.Getpgrp(), syscall.SIGTTIN)
+	}
+
+	// Keep Ctrl-Z and Ctrl-C from stopping or killing the shell itself.
+	// The signals are caught rather than ignored so that child processes
+	// still get their default behaviour.
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGTSTP, syscall.SIGTTIN)
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, syscall.SIGINT)
+	go func() {
+		for range sigint {
+			mu.Lock()
+			interrupted = true
+			cond.Broadcast()
+			mu.Unlock()
+		}
+	}()
+
+	shellPgid = syscall.Getpid()
+	if syscall.Getpgrp() != shellPgid {
+		if err := syscall.Setpgid(0, 0); err != nil {
+			shellPgid = syscall.Getpgrp()
+		}
+	}
+	setForeground(shellPgid)
+	shellModes, _ = readline.GetState(ttyFd)
+	Enabled = true
+}
+
+// New creates a job for the given command text. With control set, and job
+// control enabled, its processes get a process group of their own. A
+// background job is never handed the terminal.
+func New(text string, control, background bool) *Job {
+	return &Job{
+		Text:       text,
+		control:    control && Enabled,
+		foreground: !background,
+	}
+}
+
+// Start starts cmd as part of the job.
+func (j *Job) Start(cmd *exec.Cmd) error {
+	if j.control {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setpgid: true,
+			Pgid:    j.pgid,
+			// The child takes the terminal itself before it execs, so it
+			// never reads from it while still in the background
+			Foreground: j.foreground,
+			Ctty:       ttyFd,
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	pid := cmd.Process.Pid
+	if j.control && j.pgid == 0 {
+		j.pgid = pid
+	}
+	j.procs = append(j.procs, &process{cmd: cmd, pid: pid})
+	return nil
+}
+
+// Pid returns the process group of the job, or the process ID of its last
+// process when it has no group of its own.
+func (j *Job) Pid() int {
+	if j.pgid != 0 {
+		return j.pgid
+	}
+	if len(j.procs) > 0 {
+		return j.procs[len(j.procs)-1].pid
+	}
+	return 0
+}
+
+// State returns whether the job is running, stopped or done.
+func (j *Job) State() State {
+	stopped := false
+	for _, p := range j.procs {
+		if p.done {
+			continue
+		}
+		if !p.stopped {
+			return Running
+		}
+		stopped = true
+	}
+	if stopped {
+		return Stopped
+	}
+	return Done
+}
+
+// Stopped reports whether the job is stopped, as after Wait returns for a
+// job stopped with Ctrl-Z.
+func (j *Job) Stopped() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return j.State() == Stopped
+}
+
+// exitStatus returns the status of a finished job, which is the status of
+// its last process.
+func (j *Job) exitStatus() int {
+	if len(j.procs) == 0 {
+		return 0
+	}
+	return j.procs[len(j.procs)-1].status
+}
+
+// Statuses returns the exit status of each process of a finished job, in
+// the order they were started.
+func (j *Job) Statuses() []int {
+	mu.Lock()
+	defer mu.Unlock()
+
+	statuses := make([]int, len(j.procs))
+	for i, p := range j.procs {
+		statuses[i] = p.status
+	}
+	return statuses
+}
+
+// finish records the exit status of a process and releases it.
+func (p *process) finish(ws syscall.WaitStatus) {
+	p.done = true
+	p.stopped = false
+	if ws.Signaled() {
+		p.status = 128 + int(ws.Signal())
+	} else {
+		p.status = ws.ExitStatus()
+	}
+	p.cmd.Process.Release()
+}
+
+// wait4 waits for pid, retrying when interrupted by a signal.
+func wait4(pid int, options int) (syscall.WaitStatus, int, error) {
+	var ws syscall.WaitStatus
+	for {
+		wpid, err := syscall.Wait4(pid, &ws, options, nil)
+		if err != syscall.EINTR {
+			return ws, wpid, err
+		}
+	}
+}
+
+// Wait waits for a foreground job to finish or stop and returns its exit
+// status. A job stopped with Ctrl-Z is added to the job table and
+// reported, and its status is 128 plus the stop signal.
+func (j *Job) Wait() int {
+	// Keep an interrupt meant for the job from killing the shell
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, syscall.SIGINT)
+	defer signal.Stop(sigint)
+
+	options := 0
+	if j.control {
+		options = syscall.WUNTRACED
+	}
+
+	stopSignal := 0
+	for _, p := range j.procs {
+		if p.done {
+			continue
+		}
+		ws, _, err := wait4(p.pid, options)
+		if err != nil {
+			p.done = true
+			continue
+		}
+		if ws.Stopped() {
+			// The signal went to the whole process group
+			for _, p := range j.procs {
+				p.stopped = !p.done
+			}
+			stopSignal = int(ws.StopSignal())
+			break
+		}
+		p.finish(ws)
+	}
+
+	// Take the terminal back, remembering how the job left it
+	if j.control {
+		j.modes, _ = readline.GetState(ttyFd)
+		setForeground(shellPgid)
+		if shellModes != nil {
+			readline.Restore(ttyFd, shellModes)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if stopSignal != 0 {
+		j.foreground = false
+		if j.ID == 0 {
+			add(j)
+		}
+		lastSeq++
+		j.seq = lastSeq
+		fmt.Fprintf(os.Stderr, "\n%s\n", j.format(false))
+		return 128 + stopSignal
+	}
+	remove(j)
+	return j.exitStatus()
+}
+
+// Background adds a freshly started job to the job table without waiting
+// for it and, in an interactive shell, prints its number and process ID.
+func Background(j *Job) {
+	mu.Lock()
+	j.foreground = false
+	add(j)
+	mu.Unlock()
+
+	LastPid = j.Pid()
+	if Enabled {
+		fmt.Fprintf(os.Stderr, "[%d] %d\n", j.ID, j.Pid())
+	}
+	// The job may have exited before it was in the table
+	poll()
+}
+
+// Resume continues a stopped or background job. In the foreground the
+// job is handed the terminal and waited for, and its exit status is
+// returned.
+func Resume(j *Job, foreground bool) int {
+	mu.Lock()
+	j.foreground = foreground
+	j.changed = false
+	for _, p := range j.procs {
+		p.stopped = false
+	}
+	lastSeq++
+	j.seq = lastSeq
+	mu.Unlock()
+
+	if foreground && j.control {
+		if j.modes != nil {
+			readline.Restore(ttyFd, j.modes)
+		}
+		setForeground(j.pgid)
+	}
+
+	if j.pgid != 0 {
+		syscall.Kill(-j.pgid, syscall.SIGCONT)
+	} else {
+		for _, p := range j.procs {
+			if !p.done {
+				syscall.Kill(p.pid, syscall.SIGCONT)
+			}
+		}
+	}
+
+	if foreground {
+		return j.Wait()
+	}
+	return 0
+}
+
+// WaitFor blocks until the background job j is no longer running and
+// returns its exit status. It returns early with 130 if the shell is
+// interrupted.
+func WaitFor(j *Job) int {
+	mu.Lock()
+	defer mu.Unlock()
+
+	interrupted = false
+	for j.State() == Running && !interrupted {
+		cond.Wait()
+	}
+	if interrupted {
+		return 130
+	}
+	if j.State() == Stopped {
+		return 128 + int(syscall.SIGTSTP)
+	}
+	j.changed = false
+	remove(j)
+	return j.exitStatus()
+}
+
+// poll collects state changes of background jobs without blocking, and
+// wakes anything waiting for them.
+func poll() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, j := range table {
+		if j.foreground {
+			continue
+		}
+		before := j.State()
+		for _, p := range j.procs {
+			if p.done {
+				continue
+			}
+			ws, pid, err := wait4(p.pid, syscall.WNOHANG|syscall.WUNTRACED|syscall.WCONTINUED)
+			switch {
+			case err != nil:
+				p.done = true
+			case pid == 0:
+			case ws.Stopped():
+				p.stopped = true
+			case ws.Continued():
+				p.stopped = false
+			default:
+				p.finish(ws)
+			}
+		}
+		if j.State() != before {
+			j.changed = true
+		}
+	}
+	cond.Broadcast()
+}
+
+// Report prints, and forgets, background jobs that finished or stopped
+// since the last call. The shell calls it before each prompt.
+func Report(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, j := range append([]*Job(nil), table...) {
+		if !j.changed {
+			continue
+		}
+		j.changed = false
+		if !j.disowned {
+			fmt.Fprintln(w, j.format(false))
+		}
+		if j.State() == Done {
+			remove(j)
+		}
+	}
+}
+
+// List prints the job table. With long set it includes process IDs.
+func List(w io.Writer, long bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, j := range append([]*Job(nil), table...) {
+		if j.disowned {
+			continue
+		}
+		fmt.Fprintln(w, j.format(long))
+		if j.State() == Done {
+			j.changed = false
+			remove(j)
+		}
+	}
+}
+
+// All returns the jobs in the table, oldest first.
+func All() []*Job {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var all []*Job
+	for _, j := range table {
+		if !j.disowned {
+			all = append(all, j)
+		}
+	}
+	return all
+}
+
+// Disown removes j from the job table. It is still reaped when it exits,
+// but never reported.
+func Disown(j *Job) {
+	mu.Lock()
+	defer mu.Unlock()
+	j.disowned = true
+}
+
+// Find resolves a job spec: %N, %%, %+, %-, %prefix, %?substring, or a
+// plain job number. An empty spec means the current job.
+func Find(spec string) (*Job, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	current, previous := markers()
+	name := strings.TrimPrefix(spec, "%")
+	var match *Job
+	switch {
+	case name == "" || name == "%" || name == "+":
+		match = current
+	case name == "-":
+		match = previous
+	default:
+		if id, err := strconv.Atoi(name); err == nil {
+			for _, j := range table {
+				if j.ID == id && !j.disowned {
+					match = j
+				}
+			}
+			break
+		}
+		for _, j := range table {
+			if j.disowned {
+				continue
+			}
+			if sub, ok := strings.CutPrefix(name, "?"); ok && strings.Contains(j.Text, sub) ||
+				!ok && strings.HasPrefix(j.Text, name) {
+				if match != nil {
+					return nil, fmt.Errorf("%s: ambiguous job spec", spec)
+				}
+				match = j
+			}
+		}
+	}
+
+	if match == nil {
+		if spec == "" {
+			return nil, fmt.Errorf("no current job")
+		}
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	return match, nil
+}
+
+// add puts j in the table with the next free job number.
+func add(j *Job) {
+	id := 1
+	for _, other := range table {
+		if other.ID >= id {
+			id = other.ID + 1
+		}
+	}
+	j.ID = id
+	lastSeq++
+	j.seq = lastSeq
+	table = append(table, j)
+}
+
+// remove drops j from the table.
+func remove(j *Job) {
+	for i, other := range table {
+		if other == j {
+			table = append(table[:i], table[i+1:]...)
+			return
+		}
+	}
+}
+
+// markers returns the current (%+) and previous (%-) jobs.
+func markers() (current, previous *Job) {
+	for _, j := range table {
+		if j.disowned {
+			continue
+		}
+		if current == nil || j.seq > current.seq {
+			current, previous = j, current
+		} else if previous == nil || j.seq > previous.seq {
+			previous = j
+		}
+	}
+	return current, previous
+}
+
+// format describes j the way `jobs` lists it.
+func (j *Job) format(long bool) string {
+	marker := " "
+	if current, previous := markers(); j == current {
+		marker = "+"
+	} else if j == previous {
+		marker = "-"
+	}
+
+	var state string
+	switch j.State() {
+	case Running:
+		state = "Running"
+	case Stopped:
+		state = "Stopped"
+	case Done:
+		state = "Done"
+		if status := j.exitStatus(); status != 0 {
+			state = fmt.Sprintf("Exit %d", status)
+		}
+	}
+
+	text := j.Text
+	if j.State() == Running {
+		text += " &"
+	}
+	if long {
+		pid := ""
+		if j.Pid() != 0 {
+			pid = strconv.Itoa(j.Pid())
+		}
+		return fmt.Sprintf("[%d]%s %-6s %-22s %s", j.ID, marker, pid, state, text)
+	}
+	return fmt.Sprintf("[%d]%s  %-22s  %s", j.ID, marker, state, text)
+}
@@ -0,0 +1,36 @@
+package jobs
+
+import (
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// tcgetpgrp returns the foreground process group of the terminal fd.
+func tcgetpgrp(fd int) (int, error) {
+	var pgid int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgid)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(pgid), nil
+}
+
+// tcsetpgrp makes pgid the foreground process group of the terminal fd.
+func tcsetpgrp(fd int, pgid int) error {
+	id := int32(pgid)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCSPGRP), uintptr(unsafe.Pointer(&id)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setForeground hands the terminal to pgid. SIGTTOU is ignored for the
+// duration of the call, since the shell is usually in a background process
+// group when it takes the terminal back.
+func setForeground(pgid int) {
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	tcsetpgrp(ttyFd, pgid)
+}
@@ -1,282 +1,868 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"time"
 
 	"formalshell/cmds"
-	"formalshell/completions"
+	"formalshell/expand"
 	"formalshell/history"
+	"formalshell/jobs"
+	"formalshell/parser"
 	"formalshell/shell"
 	"github.com/chzyer/readline"
 )
 
 // Global state
 var (
+	// aliases maps alias names to their text. Aliases are expanded by the
+	// parser, so they only affect input read after they are defined.
 	aliases    = make(map[string]string)
 	customPath string
+	// interactive is set when reading commands from the terminal rather
+	// than running a script.
+	interactive bool
+	// shCompat runs external commands through /bin/sh with the config
+	// sourced, as formalshell used to. Set FORMALSHELL_SH_COMPAT=1 to
+	// enable it.
+	shCompat = os.Getenv("FORMALSHELL_SH_COMPAT") == "1"
 )
 
+// promptColors maps the color names PROMPT_COLOR accepts to their SGR
+// codes.
+var promptColors = map[string]string{
+	"black":   "30",
+	"red":     "31",
+	"green":   "32",
+	"yellow":  "33",
+	"blue":    "34",
+	"magenta": "35",
+	"cyan":    "36",
+	"white":   "37",
+}
 
-// displayPrompt generates the shell prompt, showing only the current folder name.
+// displayPrompt generates the shell prompt, showing only the current folder
+// name. The theme comes from PROMPT_ICON, PROMPT_COLOR (a color name or a
+// raw SGR code such as "1;32") and PROMPT_SYMBOL.
 func displayPrompt() string {
 	wd, err := os.Getwd()
 	if err != nil {
 		wd = "unknown"
 	}
 
-	blue := "\033[34m"
+	icon := promptVar("PROMPT_ICON", "󰅟 ")
+	symbol := promptVar("PROMPT_SYMBOL", ">")
+	color := promptVar("PROMPT_COLOR", "blue")
+	if code, ok := promptColors[color]; ok {
+		color = code
+	}
 	reset := "\033[0m"
-	return fmt.Sprintf("󰅟  %s%s%s > ", blue, filepath.Base(wd), reset)
+	return fmt.Sprintf("%s %s%s%s %s ", icon, "\033["+color+"m", filepath.Base(wd), reset, symbol)
+}
+
+// currentPrompt is the prompt readline is showing, kept so it can be put
+// back after the history picker.
+var currentPrompt string
+
+// setPrompt changes the prompt readline shows.
+func setPrompt(rl *readline.Instance, prompt string) {
+	currentPrompt = prompt
+	rl.SetPrompt(prompt)
+}
+
+// promptVar returns the value of a prompt variable, or def if it is unset.
+func promptVar(name, def string) string {
+	if value, ok := shellVars.Get(name); ok {
+		return value
+	}
+	return def
 }
 
 // handleInput processes user input, including pipes and command chaining.
 func handleInput(input string, rl *readline.Instance, hist *history.History) {
+	// The untrimmed text goes to the history, where a leading space may
+	// keep it out
+	command := input
 	input = strings.TrimSpace(input)
 	if input == "" {
 		return
 	}
+	if !expandHistory(hist, &input, &command) {
+		return
+	}
 
-	// Save the raw input to history immediately
-	if input = strings.TrimSpace(input); input != "" {
-		hist.CommandHistory[input] = true
-		if err := hist.Save(); err != nil {
-			fmt.Printf("Error saving history: %v\n", err)
+	// Keep reading lines while the input is unfinished, e.g. inside an if
+	// statement or quotes. Ctrl-C abandons the whole command
+	list, err := parser.ParseWithAliases(input, mainShell.lookupAlias)
+	for isIncomplete(err) {
+		setPrompt(rl, "> ")
+		line, readErr := rl.Readline()
+		if readErr == readline.ErrInterrupt {
+			return
+		} else if readErr != nil {
+			break
 		}
+		if !expandHistory(hist, &line, &line) {
+			return
+		}
+		input += "\n" + line
+		command += "\n" + line
+		list, err = parser.ParseWithAliases(input, mainShell.lookupAlias)
 	}
 
-	// Process the commands
-	commands := strings.Split(input, "&&")
-	for _, cmd := range commands {
-		cmd = strings.TrimSpace(cmd)
+	start := time.Now()
+	dir, _ := os.Getwd()
+	if err != nil {
+		fmt.Printf("formalshell: %v\n", err)
+		mainShell.lastStatus = 2
+	} else {
+		mainShell.runList(list, cmds.StdIO(), fgJob)
+	}
 
-		// Handle pipes (`|`)
-		if strings.Contains(cmd, "|") {
-			handlePipes(cmd)
-		} else {
-			handleCommand(cmd)
-		}
+	// Record the command once it has finished, so its status and duration
+	// are known. Commands with syntax errors are kept too, to be fixed up
+	recordHistory(rl, hist, history.Entry{
+		Command:  command,
+		Time:     start,
+		Dir:      dir,
+		Status:   mainShell.lastStatus,
+		Duration: time.Since(start),
+	})
+}
+
+// expandHistory performs history expansion such as !! on a line of input
+// and on the text recorded for it, showing the result like bash does. It
+// reports an event that can't be found and returns false, in which case
+// the input is dropped.
+func expandHistory(hist *history.History, line, command *string) bool {
+	expanded, changed, err := hist.Expand(*line)
+	if err != nil {
+		fmt.Printf("formalshell: %v\n", err)
+		mainShell.lastStatus = 1
+		return false
+	}
+	if changed {
+		fmt.Println(expanded)
+		*line, *command = expanded, expanded
 	}
+	return true
 }
 
-// handleCommand processes a single command without pipes.
-func handleCommand(input string) {
-	parts := strings.Fields(input)
-	if len(parts) == 0 {
+// recordHistory adds a finished command to the history, and to readline's
+// own list for the up arrow.
+func recordHistory(rl *readline.Instance, hist *history.History, entry history.Entry) {
+	hist.Options = historyOptions()
+	kept, err := hist.Add(entry)
+	if err != nil {
+		fmt.Printf("Error saving history: %v\n", err)
+	}
+	if !kept {
 		return
 	}
+	// Erased duplicates and commands picked up from other shells mean
+	// readline's list has to be rebuilt
+	if hist.Options.EraseDups || hist.Options.Share {
+		loadReadlineHistory(rl, hist)
+	} else {
+		rl.SaveHistory(hist.Entries[len(hist.Entries)-1].Command)
+	}
+}
 
-	command := parts[0]
-	
-	// Check aliases first
-	if alias, exists := aliases[command]; exists {
-		// Replace the command with its alias
-		aliasParts := strings.Fields(alias)
-		command = aliasParts[0]
-		args := append(aliasParts[1:], parts[1:]...)
-		parts = append([]string{command}, args...)
-	}
-	
-	args := parts[1:]
-
-	// Handle built-in commands
-	switch command {
-	case "exit":
-		fmt.Println("Goodbye!")
-		os.Exit(0)
-	case "cd":
-		cmds.HandleCD(args)
-		return
-	case "ls":
-		cmds.CustomLS(args...)
-		return
+// loadReadlineHistory replaces readline's history with the entries of
+// hist, oldest first, so the up arrow walks back through them in order.
+func loadReadlineHistory(rl *readline.Instance, hist *history.History) {
+	rl.ResetHistory()
+	for _, entry := range hist.Entries {
+		rl.SaveHistory(entry.Command)
 	}
+}
 
-	// Execute external commands
-	executeCommand(command, args)
+// historyOptions reads the history settings from HISTSIZE, HISTCONTROL and
+// the sharehistory option.
+func historyOptions() history.Options {
+	opts := history.Options{Share: options["sharehistory"]}
+	if size, ok := shellVars.Get("HISTSIZE"); ok {
+		opts.Size, _ = strconv.Atoi(size)
+	}
+	if control, ok := shellVars.Get("HISTCONTROL"); ok {
+		history.ParseControl(&opts, control)
+	}
+	return opts
 }
 
-// handlePipes splits a command by pipes (`|`) and sets up a pipeline.
-func handlePipes(input string) {
-	commands := strings.Split(input, "|")
-	var prevCmd *exec.Cmd
+// isIncomplete reports whether err means the input ended too early.
+func isIncomplete(err error) bool {
+	var syntaxErr *parser.SyntaxError
+	return errors.As(err, &syntaxErr) && syntaxErr.Incomplete
+}
 
-	for i, cmdStr := range commands {
-		cmdStr = strings.TrimSpace(cmdStr)
-		parts := strings.Fields(cmdStr)
+// jobMode controls how external commands are run and waited for.
+type jobMode int
+
+const (
+	// fgJob waits for the commands, handing them the terminal when job
+	// control is enabled so that Ctrl-C and Ctrl-Z reach them.
+	fgJob jobMode = iota
+	// bgJob starts the commands as a background job and returns at once.
+	bgJob
+	// subJob waits for the commands without touching the terminal, as
+	// in the stages of a pipeline or a completion function.
+	subJob
+)
 
-		if len(parts) == 0 {
+// runList runs each and-or list in turn, as separated by `;`, `&` or
+// newlines, and returns the status of the last one. It stops early when a
+// break, continue, return or exit is pending, and returns the status of an
+// exit.
+func (sh *shellState) runList(list *parser.List, stdio *cmds.IO, mode jobMode) int {
+	for _, andOr := range list.Items {
+		if sh.pending.kind != 0 {
+			break
+		}
+		if !andOr.Background {
+			sh.lastStatus = sh.runAndOr(andOr, stdio, mode)
 			continue
 		}
 
-		cmd := exec.Command(parts[0], parts[1:]...)
-
-		// Connect stdout of the previous command to stdin of the current one
-		if prevCmd != nil {
-			pipe, _ := prevCmd.StdoutPipe()
-			cmd.Stdin = pipe
+		// A single pipeline becomes a real job; anything longer, or a lone
+		// compound command, runs in a subshell
+		if len(andOr.Pipelines) == 1 && !isCompound(andOr.Pipelines[0]) {
+			sh.runPipeline(andOr.Pipelines[0], stdio, bgJob)
 		} else {
-			cmd.Stdin = os.Stdin
-		}
-
-		// Set stdout to os.Stdout for the last command
-		if i == len(commands)-1 {
-			cmd.Stdout = os.Stdout
+			sh.startBackground(andOr, stdio)
 		}
+		sh.lastStatus = 0
+	}
+	if sh.pending.kind == jumpExit {
+		return sh.pending.status
+	}
+	return sh.lastStatus
+}
 
-		cmd.Stderr = os.Stderr
+// startBackground starts an and-or list as a background job run by a
+// subshell, so that nothing it changes reaches the shell.
+func (sh *shellState) startBackground(andOr *parser.AndOr, stdio *cmds.IO) {
+	job := jobs.New(andOr.Source, true, true)
+	if sh.startSubshell(job, &subshellState{Source: andOr.Source, List: true}, stdio) < 0 {
+		jobs.Background(job)
+	}
+}
 
-		// Start the previous command before chaining
-		if prevCmd != nil {
-			_ = prevCmd.Start()
+// runAndOr runs a chain of pipelines joined by `&&` and `||`, skipping a
+// pipeline when the previous status makes its operator short-circuit.
+func (sh *shellState) runAndOr(andOr *parser.AndOr, stdio *cmds.IO, mode jobMode) int {
+	status := sh.runPipeline(andOr.Pipelines[0], stdio, mode)
+	for i, op := range andOr.Ops {
+		if sh.pending.kind != 0 {
+			break
+		}
+		if (op == "&&") != (status == 0) {
+			continue
 		}
+		status = sh.runPipeline(andOr.Pipelines[i+1], stdio, mode)
+	}
+	return status
+}
 
-		prevCmd = cmd
+// runPipeline runs a single pipeline and records its status in $?,
+// and the status of each of its commands in $PIPESTATUS. There are no
+// arrays, so unlike bash's, $PIPESTATUS is a string with the statuses
+// separated by spaces.
+func (sh *shellState) runPipeline(pipeline *parser.Pipeline, stdio *cmds.IO, mode jobMode) int {
+	var statuses []int
+	// Handle pipes (`|`)
+	if len(pipeline.Cmds) > 1 {
+		statuses = sh.handlePipes(pipeline, stdio, mode)
+	} else if cmd, ok := pipeline.Cmds[0].(*parser.SimpleCommand); ok {
+		statuses = []int{sh.handleCommand(cmd, stdio, mode, pipeline.Source)}
+	} else {
+		statuses = []int{sh.runCompound(pipeline.Cmds[0], stdio, mode)}
 	}
 
-	// Run the final command in the chain
-	if prevCmd != nil {
-		_ = prevCmd.Run()
+	sh.lastStatus = pipelineStatus(statuses)
+	if pipeline.Negated {
+		sh.lastStatus = boolStatus(sh.lastStatus != 0)
+	}
+	fields := make([]string, len(statuses))
+	for i, status := range statuses {
+		fields[i] = strconv.Itoa(status)
 	}
+	shellVars.Set("PIPESTATUS", strings.Join(fields, " "))
+	return sh.lastStatus
 }
 
-// executeCommand runs an external command.
-func executeCommand(command string, args []string) {
-	// Set up signal handling
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT)
-	defer signal.Stop(sigChan)
+// pipelineStatus returns the exit status of a pipeline: the status of its
+// last command or, with `set -o pipefail`, of the last command that failed.
+func pipelineStatus(statuses []int) int {
+	if options["pipefail"] {
+		for i := len(statuses) - 1; i >= 0; i-- {
+			if statuses[i] != 0 {
+				return statuses[i]
+			}
+		}
+		return 0
+	}
+	return statuses[len(statuses)-1]
+}
 
-	// Create a shell script that will execute the command
-	script := fmt.Sprintf(". ~/.config/formalshell/config\n%s %s", command, strings.Join(args, " "))
-	
-	tmpFile, err := os.CreateTemp("", "formalsh_cmd_*.sh")
+// handleCommand processes a single command without pipes and returns its
+// exit status. text is the command as typed, used to describe it as a job.
+func (sh *shellState) handleCommand(cmd *parser.SimpleCommand, stdio *cmds.IO, mode jobMode, text string) int {
+	// Command substitutions run with the same job mode as the command
+	env := shellEnv{sh: sh, mode: mode}
+	sh.substStatus = 0
+	parts, err := expand.Fields(env, cmd.Args...)
 	if err != nil {
-		fmt.Printf("Error creating temp file: %v\n", err)
-		return
+		return sh.expandError(err, stdio)
 	}
-	defer os.Remove(tmpFile.Name())
 
-	if _, err := tmpFile.WriteString(script); err != nil {
-		fmt.Printf("Error writing temp file: %v\n", err)
-		return
+	// Apply redirections before anything else so they also cover builtins
+	redirected, closeFiles, err := applyRedirects(env, cmd.Redirs, stdio)
+	if err != nil {
+		return sh.expandError(err, stdio)
+	}
+	defer closeFiles()
+	stdio = redirected
+
+	assigns, err := evalAssigns(env, cmd.Assigns)
+	if err != nil {
+		return sh.expandError(err, stdio)
 	}
-	tmpFile.Close()
 
-	// Execute the command in a shell context
-	cmd := exec.Command("/bin/sh", tmpFile.Name())
-	cmd.Env = append(os.Environ(), "PATH="+customPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
+	// A command made only of assignments sets shell variables, unless it
+	// is in the background. Its status is that of the last command
+	// substitution, if there was one
+	if len(parts) == 0 {
+		if mode != bgJob {
+			setVars(assigns)
+		}
+		return sh.substStatus
+	}
 
-	// Start command in background
-	if err := cmd.Start(); err != nil {
-		fmt.Printf("%s: command not found\n", command)
-		return
+	// In the background, functions and builtins run in a subshell, so
+	// that the shell carries on and nothing they change reaches it
+	_, isFunction := sh.functions[parts[0]]
+	_, isBuiltin := builtins[parts[0]]
+	if mode == bgJob && (isFunction || isBuiltin) {
+		job := jobs.New(text, true, true)
+		if status := sh.startSubshell(job, &subshellState{Args: parts, Assigns: assigns}, stdio); status >= 0 {
+			return status
+		}
+		jobs.Background(job)
+		return 0
 	}
 
-	// Handle command interruption
-	go func() {
-		select {
-		case <-sigChan:
-			if cmd.Process != nil {
-				cmd.Process.Signal(syscall.SIGINT)
+	// Functions come first, ahead of builtins and external commands.
+	// Aliases have already been expanded by the parser
+	if fn, ok := sh.functions[parts[0]]; ok {
+		return withVars(assigns, func() int {
+			return sh.callFunction(fn, parts[1:], stdio, mode)
+		})
+	}
+
+	command, args := parts[0], parts[1:]
+
+	// Handle built-in commands, with any prefix assignments in effect
+	// only while they run
+	if builtin, ok := builtins[command]; ok {
+		return withVars(assigns, func() int {
+			return builtin(sh, stdio, args)
+		})
+	}
+
+	// Execute external commands
+	return executeCommand(command, args, assigns, stdio, mode, text)
+}
+
+// handlePipes runs commands joined by pipes (`|`) and returns the exit
+// status of each one. External commands share a single job with the
+// subshells that run builtins, functions and compound commands, except
+// that the last command runs in a goroutine writing to its end of the pipe
+// when the shell waits for the pipeline.
+func (sh *shellState) handlePipes(pipeline *parser.Pipeline, stdio *cmds.IO, mode jobMode) []int {
+	job := jobs.New(pipeline.Source, mode != subJob, mode == bgJob)
+	env := shellEnv{sh: sh, mode: mode}
+	statuses := make([]int, len(pipeline.Cmds))
+	// procs maps the stages run as processes to their index in the job
+	procs := make(map[int]int)
+	var builtinsDone sync.WaitGroup
+	stdin := stdio.Stdin
+
+	for i, stage := range pipeline.Cmds {
+		// Connect stdout of this command to stdin of the next one
+		stageIO := &cmds.IO{Stdin: stdin, Stdout: stdio.Stdout, Stderr: stdio.Stderr}
+		var pipeReader, pipeWriter *os.File
+		if i < len(pipeline.Cmds)-1 {
+			var err error
+			pipeReader, pipeWriter, err = os.Pipe()
+			if err != nil {
+				fmt.Fprintf(stdio.Stderr, "formalshell: %v\n", err)
+				closeStream(stdin, stdio)
+				for j := i; j < len(statuses); j++ {
+					statuses[j] = 1
+				}
+				break
 			}
+			stageIO.Stdout = pipeWriter
 		}
-	}()
 
-	// Wait for command completion
-	err = cmd.Wait()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			// Don't print status for interrupted commands
-			if exitErr.ExitCode() != int(syscall.SIGINT) {
-				fmt.Printf("Command exited with status %d\n", exitErr.ExitCode())
+		// release closes this stage's ends of the pipes once it no longer
+		// needs them, so its neighbours see EOF or a broken pipe
+		in, out := stdin, pipeWriter
+		release := func() {
+			if out != nil {
+				out.Close()
 			}
+			closeStream(in, stdio)
 		}
-		return
+
+		// Only the last command runs in the shell itself, and only if the
+		// shell waits for it: the others run in subshells
+		inSubshell := i < len(pipeline.Cmds)-1 || mode == bgJob
+
+		var builtin func() int
+		status := 0
+		switch simple, ok := stage.(*parser.SimpleCommand); {
+		case ok:
+			builtin, status = sh.startStage(job, simple, stageIO, env, inSubshell)
+		case inSubshell:
+			status = sh.startSubshell(job, &subshellState{Source: pipeline.Source, Stage: i}, stageIO)
+		default:
+			// Compound commands run in a goroutine, like builtins
+			stage := stage
+			builtin = func() int {
+				return sh.runCompound(stage, stageIO, subJob)
+			}
+		}
+		switch {
+		case builtin != nil:
+			builtinsDone.Add(1)
+			go func(i int) {
+				defer builtinsDone.Done()
+				statuses[i] = builtin()
+				release()
+			}(i)
+		case status < 0:
+			// Started as a process, which holds its own copies of the pipes
+			procs[i] = len(procs)
+			release()
+		default:
+			statuses[i] = status
+			release()
+		}
+
+		if pipeReader != nil {
+			stdin = pipeReader
+		}
+	}
+
+	if mode == bgJob {
+		jobs.Background(job)
+		return make([]int, len(statuses))
+	}
+
+	// Wait for every command in the chain. A stopped job keeps running
+	// its builtins, so don't wait for those
+	status := job.Wait()
+	if job.Stopped() {
+		for i := range statuses {
+			statuses[i] = status
+		}
+		return statuses
 	}
+	builtinsDone.Wait()
+
+	exited := job.Statuses()
+	for stage, proc := range procs {
+		statuses[stage] = exited[proc]
+	}
+	return statuses
 }
 
-func loadConfig() {
-	homeDir, err := os.UserHomeDir()
+// startStage prepares one command of a pipeline, expanding its words with
+// env. A builtin or function is returned as a function for the caller to
+// run in sh, unless inSubshell is set; an external command, or a builtin or
+// function in a subshell, is started as part of job, and status is then
+// -1. Otherwise status is the exit status of a command that could not be
+// run.
+func (sh *shellState) startStage(job *jobs.Job, simple *parser.SimpleCommand, stdio *cmds.IO, env shellEnv, inSubshell bool) (builtin func() int, status int) {
+	parts, err := expand.Fields(env, simple.Args...)
 	if err != nil {
-		return
+		return nil, sh.expandError(err, stdio)
+	}
+	redirected, closeFiles, err := applyRedirects(env, simple.Redirs, stdio)
+	if err != nil {
+		return nil, sh.expandError(err, stdio)
+	}
+	stdio = redirected
+	assigns, err := evalAssigns(env, simple.Assigns)
+	if err != nil {
+		closeFiles()
+		return nil, sh.expandError(err, stdio)
+	}
+	if len(parts) == 0 {
+		closeFiles()
+		return nil, 0
 	}
 
-	// First source system profile and zshenv to get basic PATH and env vars
-	script := `
-		. /etc/profile
-		[ -f ~/.zshenv ] && . ~/.zshenv
-		env > "$TMPDIR/formalsh_env"
-	`
-	tmpFile, err := os.CreateTemp("", "formalsh_*.sh")
+	_, isFunction := sh.functions[parts[0]]
+	_, isBuiltin := builtins[parts[0]]
+	if inSubshell && (isFunction || isBuiltin) {
+		defer closeFiles()
+		return nil, sh.startSubshell(job, &subshellState{Args: parts, Assigns: assigns}, stdio)
+	}
+
+	if fn, ok := sh.functions[parts[0]]; ok {
+		return func() int {
+			defer closeFiles()
+			return withVars(assigns, func() int {
+				return sh.callFunction(fn, parts[1:], stdio, subJob)
+			})
+		}, 0
+	}
+
+	command, args := parts[0], parts[1:]
+
+	if fn, ok := builtins[command]; ok {
+		return func() int {
+			defer closeFiles()
+			return withVars(assigns, func() int {
+				return fn(sh, stdio, args)
+			})
+		}, 0
+	}
+
+	defer closeFiles()
+	cmd, err := shell.Command(command, args, customPath)
 	if err == nil {
-		defer os.Remove(tmpFile.Name())
-		if _, err := tmpFile.WriteString(script); err == nil {
-			tmpFile.Close()
-			cmd := exec.Command("/bin/sh", tmpFile.Name())
-			cmd.Run()
-
-			// Read and apply environment
-			if envData, err := os.ReadFile(os.Getenv("TMPDIR") + "/formalsh_env"); err == nil {
-				envVars := strings.Split(string(envData), "\n")
-				for _, line := range envVars {
-					if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
-						os.Setenv(parts[0], parts[1])
-						if parts[0] == "PATH" {
-							customPath = parts[1]
-						}
-					}
-				}
-				os.Remove(os.Getenv("TMPDIR") + "/formalsh_env")
-			}
-		}
+		cmd.Env = append(cmd.Env, assigns...)
+		cmd.Stdin = stdio.Stdin
+		cmd.Stdout = stdio.Stdout
+		cmd.Stderr = stdio.Stderr
+		err = job.Start(cmd)
+	}
+	if err != nil {
+		return nil, commandError(command, err, stdio)
 	}
+	return nil, -1
+}
 
-	// Then load our specific config
-	configPath := filepath.Join(homeDir, ".config", "formalshell", "config")
-	if _, err := os.Stat(configPath); err == nil {
-		cmd := exec.Command("/bin/sh", configPath)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Env = os.Environ()
-		if err := cmd.Run(); err != nil {
-			fmt.Printf("Error loading formalsh config: %v\n", err)
-		}
+// closeStream closes r if it is a pipe end opened for a pipeline, rather
+// than the pipeline's own stdin.
+func closeStream(r io.Reader, stdio *cmds.IO) {
+	if f, ok := r.(*os.File); ok && r != stdio.Stdin {
+		f.Close()
 	}
 }
 
-func main() {
-	// Load config file before starting shell
+// executeCommand runs an external command as a job and returns its exit
+// status. env holds NAME=value pairs added to the command's environment.
+func executeCommand(command string, args, env []string, stdio *cmds.IO, mode jobMode, text string) int {
+	var cmd *exec.Cmd
 	var err error
-	customPath, err = shell.LoadConfig()
+	if shCompat {
+		// Old behaviour: source the config and run the command through sh
+		cmd, err = shell.CompatCommand(command, args, customPath)
+	} else {
+		cmd, err = shell.Command(command, args, customPath)
+	}
 	if err != nil {
-		fmt.Printf("Error loading config: %v\n", err)
-		os.Exit(1)
+		return commandError(command, err, stdio)
+	}
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = stdio.Stdout
+	cmd.Stderr = stdio.Stderr
+	cmd.Stdin = stdio.Stdin
+
+	// Start command in its own job
+	job := jobs.New(text, mode != subJob, mode == bgJob)
+	if err := job.Start(cmd); err != nil {
+		return commandError(command, err, stdio)
+	}
+
+	if mode == bgJob {
+		jobs.Background(job)
+		return 0
+	}
+
+	// Wait for command completion
+	return job.Wait()
+}
+
+// expandError reports an error expanding the words of a command and
+// returns the command's status. ${NAME?word} failing also makes a
+// non-interactive shell exit, as bash does, with status 127.
+func (sh *shellState) expandError(err error, stdio *cmds.IO) int {
+	fmt.Fprintf(stdio.Stderr, "formalshell: %v\n", err)
+	var unset *expand.UnsetError
+	if errors.As(err, &unset) && !interactive {
+		sh.pending.kind, sh.pending.status = jumpExit, 127
+		return 127
+	}
+	return 1
+}
+
+// commandError reports a command that could not be started and returns
+// the matching exit status: 127 when it wasn't found, 126 otherwise.
+func commandError(command string, err error, stdio *cmds.IO) int {
+	if errors.Is(err, shell.ErrNotFound) {
+		fmt.Fprintf(stdio.Stderr, "%s: command not found\n", command)
+		return 127
+	}
+	fmt.Fprintf(stdio.Stderr, "%s: %v\n", command, err)
+	return 126
+}
+
+var (
+	// lastLine and lastPos are the line being edited and the cursor's
+	// position in it as readline last reported them.
+	lastLine []rune
+	lastPos  int
+	// pendingLine and pendingPos replace the line being edited and the
+	// cursor once readline has handled the current key, if replacing is
+	// set. redraw just has the line drawn again.
+	pendingLine []rune
+	pendingPos  int
+	replacing   bool
+	redraw      bool
+)
+
+// replaceLine replaces the line being edited with line, with the cursor at
+// pos. It is meant for key handlers in filterInput, which run before
+// readline has handled the key and can't change the line themselves.
+func replaceLine(line []rune, pos int) {
+	pendingLine, pendingPos, replacing = line, pos, true
+}
+
+// redrawLine has readline draw the line again after the current key, such
+// as when the completion menu below it has closed.
+func redrawLine() {
+	redraw = true
+}
+
+// onLineChange is readline's listener, called after every key. It puts a
+// line from replaceLine in place and keeps the history picker up to date.
+func onLineChange(line []rune, pos int, key rune) ([]rune, int, bool) {
+	if replacing {
+		replacing, redraw = false, false
+		return pendingLine, pendingPos, true
+	}
+	lastLine = append(lastLine[:0], line...)
+	lastPos = pos
+	if picker.active {
+		updatePicker(line)
+	}
+	if redraw {
+		redraw = false
+		return line, pos, true
+	}
+	return nil, 0, false
+}
+
+// linePainter is readline's Painter. It adds the completion menu, drawn
+// below the line, or else the autosuggestion to the line readline draws.
+type linePainter struct{}
+
+func (linePainter) Paint(line []rune, pos int) []rune {
+	if menu.active {
+		return append([]rune(menuSequence(line)), line...)
+	}
+	ghost := suggestionText(line, pos)
+	if len(ghost) == 0 {
+		return line
+	}
+	return append(append(make([]rune, 0, len(line)+len(ghost)), line...), ghost...)
+}
+
+// filterInput drops Ctrl-Z at the prompt. readline would otherwise suspend
+// the shell itself, which job control keeps from ever being resumed. Keys
+// bound with the bind builtin are translated to their actions here,
+// reverse-search-history opens the history picker, Tab completes and the
+// keys that accept an autosuggestion take it.
+func filterInput(r rune) (rune, bool) {
+	if action, ok := keyBindings[r]; ok {
+		r = editActions[action]
+	}
+	if picker.active {
+		return pickerKey(r), true
+	}
+	if menu.active {
+		return menuKey(r), true
+	}
+	if r == readline.CharTab {
+		completeWord()
+		return readline.CharBell, true
 	}
+	if suggestionKey(r) {
+		return readline.CharBell, true
+	}
+	if r == readline.CharBckSearch && shellHistory != nil {
+		openPicker()
+		return readline.CharBell, true
+	}
+	if r == readline.CharCtrlZ {
+		return r, false
+	}
+	return r, true
+}
+
+func main() {
+	if len(os.Args) == 2 && os.Args[1] == subshellArg {
+		os.Exit(runSubshell())
+	}
+
+	command := flag.String("c", "", "run `commands` instead of a script or stdin")
+	debugEnv := flag.Bool("debug-env", false, "import the login environment, show what it changed and exit")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: formalshell [--debug-env] [-c commands [name [arg ...]]] [script [arg ...]]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// Run non-interactively when given commands, a script, or input that
+	// isn't a terminal
+	args := flag.Args()
+	switch {
+	case *debugEnv:
+		os.Exit(debugEnvReport(os.Stdout))
+	case isFlagSet("c"):
+		if len(args) > 0 {
+			scriptName, args = args[0], args[1:]
+		}
+		mainShell.positional = args
+		os.Exit(runScript(*command))
+	case len(args) > 0:
+		src, err := os.ReadFile(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "formalshell: %v\n", err)
+			os.Exit(127)
+		}
+		scriptName, mainShell.positional = args[0], args[1:]
+		os.Exit(runScript(string(src)))
+	case !readline.IsTerminal(int(os.Stdin.Fd())):
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "formalshell: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(runScript(string(src)))
+	}
+
+	runInteractive()
+}
+
+// isFlagSet reports whether the named flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// runScript runs src as a script without a prompt, history or job control,
+// and returns the status of the last command. The environment is used as it
+// is, without loading the config. Like the config, the script is run one
+// command at a time, so aliases it defines apply to the commands after
+// them and a syntax error only skips the command it is in.
+func runScript(src string) int {
+	customPath = os.Getenv("PATH")
+	initVars()
+	jobs.Init(false)
+
+	return mainShell.runSource(scriptName, src, cmds.StdIO())
+}
+
+// debugEnvReport imports the login environment the way an interactive
+// shell would and writes the files it sourced and every variable it set or
+// changed to w.
+func debugEnvReport(w io.Writer) int {
+	files := shell.LoginFiles()
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			fmt.Fprintf(w, "skipped %s: %v\n", file, err)
+		} else {
+			fmt.Fprintf(w, "sourced %s\n", file)
+		}
+	}
+
+	changes, err := shell.ImportEnv(files)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "formalshell: %v\n", err)
+		return 1
+	}
+	for _, change := range changes {
+		if change.Added {
+			fmt.Fprintf(w, "+ %s=%s\n", change.Name, shell.Quote(change.New))
+		} else {
+			fmt.Fprintf(w, "~ %s=%s (was %s)\n", change.Name, shell.Quote(change.New), shell.Quote(change.Old))
+		}
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "no changes")
+	}
+	return 0
+}
+
+// runInteractive runs the interactive readline loop until end of input.
+func runInteractive() {
+	interactive = true
+
+	// Import the login environment before starting the shell
+	if _, err := shell.ImportEnv(shell.LoginFiles()); err != nil {
+		fmt.Printf("Error importing environment: %v\n", err)
+	}
+	customPath = os.Getenv("PATH")
+	initVars()
+
+	// Run the config in the shell itself, then load the aliases saved at
+	// the prompt, which take precedence
+	mainShell.loadConfig(cmds.StdIO())
+	if path, err := aliasFile(); err == nil {
+		if err := loadAliases(mainShell, path, true); err != nil {
+			fmt.Printf("Error loading aliases: %v\n", err)
+		}
+	}
+	persistAliases = true
 
 	// Initialize history
-	hist, err := history.New()
+	histFile, _ := shellVars.Get("HISTFILE")
+	hist, err := history.New(histFile)
 	if err != nil {
 		fmt.Printf("Error initializing history: %v\n", err)
 		os.Exit(1)
 	}
+	hist.Options = historyOptions()
+	if err := hist.Load(); err != nil {
+		fmt.Printf("Error loading history: %v\n", err)
+	}
+	shellHistory = hist
+
+	// Take control of the terminal for job control
+	jobs.Init(true)
 
 	// Configure readline
 	config := &readline.Config{
-		AutoComplete:           completions.CreateCompleter(hist.CommandHistory),
+		Stdin:                  readline.NewCancelableStdin(&backTabReader{r: os.Stdin}),
 		InterruptPrompt:        "^C",
-		EOFPrompt:             "exit",
-		DisableAutoSaveHistory: false,
+		EOFPrompt:              "exit",
+		DisableAutoSaveHistory: true,
+		HistoryLimit:           hist.Options.Limit(),
 		HistorySearchFold:      true,
+		FuncFilterInputRune:    filterInput,
+		Listener:               readline.FuncListener(onLineChange),
+		Painter:                linePainter{},
 	}
 
 	instance, err := readline.NewEx(config)
@@ -284,15 +870,25 @@ func main() {
 		panic(err)
 	}
 	defer instance.Close()
+	lineEditor = instance
 
-	// Load command history
-	if err := hist.Load(instance); err != nil {
-		fmt.Printf("Error loading history: %v\n", err)
-	}
-	defer hist.Save()
+	// Fill readline's history, oldest first
+	loadReadlineHistory(instance, hist)
 
 	for {
-		instance.SetPrompt(displayPrompt())
+		// Tell the user about background jobs that finished or stopped
+		jobs.Report(os.Stderr)
+
+		// Pick up commands run in other shells
+		if options["sharehistory"] {
+			if changed, err := hist.Sync(); err != nil {
+				fmt.Printf("Error reading history: %v\n", err)
+			} else if changed {
+				loadReadlineHistory(instance, hist)
+			}
+		}
+
+		setPrompt(instance, displayPrompt())
 		line, err := instance.Readline()
 		if err != nil {
 			if err == readline.ErrInterrupt {
@@ -305,9 +901,6 @@ func main() {
 			continue
 		}
 		handleInput(line, instance, hist)
-
-		// Save history but keep the existing completer
-		instance.SaveHistory(line)
 	}
 
 	fmt.Println("Shell exited.")
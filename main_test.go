@@ -0,0 +1,138 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Subshells run the test binary itself
+	if len(os.Args) == 2 && os.Args[1] == subshellArg {
+		os.Exit(runSubshell())
+	}
+	os.Exit(m.Run())
+}
+
+// runTestScript runs src with runScript in a fresh shell started in /tmp,
+// and returns its status and what it wrote to stdout and stderr.
+func runTestScript(t *testing.T, src string) (int, string) {
+	t.Helper()
+	out, err := os.Create(t.TempDir() + "/out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, stdout, stderr := os.Stdin, os.Stdout, os.Stderr
+	savedOptions := maps.Clone(options)
+	defer func() {
+		os.Stdin, os.Stdout, os.Stderr = stdin, stdout, stderr
+		options = savedOptions
+		os.Chdir(wd)
+	}()
+	os.Stdin, os.Stdout, os.Stderr = devNull, out, out
+	mainShell = newShellState()
+	aliases = make(map[string]string)
+	if err := os.Chdir("/tmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	status := runScript(src)
+	output, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, string(output)
+}
+
+func TestRunScript(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"echo a; false || echo b && echo c", "a\nb\nc\n"},
+		{"x=1; echo $x $(echo $x)", "1 1\n"},
+		{"f() { echo $1 $(echo $2); }; f a b", "a b\n"},
+		{"f() { return 3; }; f; echo $?", "3\n"},
+		{"x=$(echo out; exit 3); echo $? $x", "3 out\n"},
+		{"echo a | { k=1; cat; }; echo k=$k", "a\nk=1\n"},
+		{"false | true; echo $? $PIPESTATUS", "0 1 0\n"},
+		{"set -o pipefail; false | true; echo $?", "1\n"},
+		{"alias hi='echo hello'\nhi there", "hello there\n"},
+		{"for i in 1 2; do echo $i; done | cat", "1\n2\n"},
+	}
+	for _, tt := range tests {
+		if _, got := runTestScript(t, tt.src); got != tt.want {
+			t.Errorf("running %q printed %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+// TestSubshells checks that what runs in a subshell, be it a command
+// substitution, a background job or a pipeline stage the shell doesn't
+// wait for, leaves the shell's variables, aliases, options and working
+// directory alone.
+func TestSubshells(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		// Command substitutions
+		{"x=1; echo $(x=5; echo sub); echo x=$x", "sub\nx=1\n"},
+		{"echo $(cd /)$(alias a=b)$(export E=1); pwd; alias; echo E=$E", "\n/tmp\nE=\n"},
+		{"echo $(set -o pipefail); false | true; echo $?", "\n0\n"},
+		{"echo `x=5`; echo x=$x", "\nx=\n"},
+		{"echo $(exit 2); echo after", "\nafter\n"},
+
+		// Background jobs
+		{"cd / & wait; pwd", "/tmp\n"},
+		{"f() { x=1; cd /; }; f & wait; echo x=$x; pwd", "x=\n/tmp\n"},
+		{"x=1 & wait; echo x=$x", "x=\n"},
+		{"cd / && y=7 & wait; echo y=$y; pwd", "y=\n/tmp\n"},
+		{"for i in 1; do alias a=b; z=$i; done & wait; alias; echo z=$z", "z=\n"},
+		{"{ cd /; set -o pipefail; } & wait; pwd; false | true; echo $?", "/tmp\n0\n"},
+		{"exit 4 & wait $!; echo $? after", "4 after\n"},
+		{"sleep 0.1 && echo done & echo first; wait", "first\ndone\n"},
+
+		// Pipeline stages before the last
+		{"cd / | cat; pwd", "/tmp\n"},
+		{"export E=1 | cat; echo E=$E", "E=\n"},
+		{"f() { v=2; alias a=b; }; f | cat; echo v=$v; alias", "v=\n"},
+		{"{ u=1; cd /; } | cat; echo u=$u; pwd", "u=\n/tmp\n"},
+		{"while true; do w=1; break; done | cat; echo w=$w", "w=\n"},
+	}
+	for _, tt := range tests {
+		if _, got := runTestScript(t, tt.src); got != tt.want {
+			t.Errorf("running %q printed %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestScriptExit(t *testing.T) {
+	tests := []struct {
+		src    string
+		status int
+		want   string
+	}{
+		{"f() { exit 4; }; f | cat; echo $PIPESTATUS", 0, "4 0\n"},
+		{"echo ${unset?gone}; echo after", 127, "formalshell: unset: gone\n"},
+		{"echo \"$(echo ${unset?gone})\"; echo after", 0, "formalshell: unset: gone\n\nafter\n"},
+		{"fi\necho after", 0, "formalshell:1: syntax error: unexpected word `fi'\nafter\n"},
+	}
+	for _, tt := range tests {
+		status, got := runTestScript(t, tt.src)
+		if status != tt.status || got != tt.want {
+			t.Errorf("running %q = %d, %q, want %d, %q", tt.src, status, got, tt.status, tt.want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"formalshell/cmds"
+	"formalshell/completions"
+	"github.com/chzyer/readline"
+)
+
+// charBackTab is the key filterInput sees for Shift-Tab. readline drops
+// the sequence terminals send for it, so backTabReader translates it
+// first.
+const charBackTab = '\uE000'
+
+// backTabReader translates Shift-Tab in terminal input to charBackTab. Both
+// are three bytes long, so the input keeps its length. A read that ends
+// partway into what may be the sequence keeps that part back for the next
+// read, as the rest can arrive separately.
+type backTabReader struct {
+	r    io.Reader
+	held []byte
+}
+
+func (b *backTabReader) Read(p []byte) (int, error) {
+	for {
+		n := copy(p, b.held)
+		m, err := b.r.Read(p[n:])
+		n += m
+		copy(p, bytes.ReplaceAll(p[:n], []byte("\033[Z"), []byte(string(charBackTab))))
+
+		b.held = nil
+		if err == nil {
+			for _, prefix := range []string{"\033[", "\033"} {
+				if bytes.HasSuffix(p[:n], []byte(prefix)) {
+					b.held = []byte(prefix)
+					n -= len(prefix)
+					break
+				}
+			}
+		}
+		// Readers shouldn't return nothing, so wait for the rest
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// completionMenu is the menu of candidates that Tab opens below the line
+// when they have nothing more in common to insert. Moving through it puts
+// the selected candidate in the line.
+type completionMenu struct {
+	active     bool
+	ctx        *completions.Context
+	candidates []completions.Candidate
+	// selected is the candidate in the line, or -1 before one is chosen.
+	selected int
+	// before and after are the parts of the line around the word being
+	// completed, and original the line when the menu opened, put back if
+	// it is cancelled.
+	before, after []rune
+	original      []rune
+	pos           int
+	// columns is how many candidates the menu last showed per row, for
+	// moving up and down.
+	columns int
+}
+
+var menu completionMenu
+
+// completeWord handles Tab: it inserts the only candidate for the word
+// under the cursor, or as much as all the candidates have in common, and
+// otherwise opens the menu.
+func completeWord() {
+	line, pos := lastLine, lastPos
+	ctx := completions.NewContext(line, pos)
+	candidates := completer.Complete(ctx)
+	if len(candidates) == 0 {
+		return
+	}
+
+	start := pos - len([]rune(ctx.Raw))
+	before := append([]rune(nil), line[:start]...)
+	after := append([]rune(nil), line[pos:]...)
+	switch common := completions.CommonPrefix(candidates); {
+	case len(candidates) == 1:
+		insertCompletion(before, completions.Insertion(ctx, candidates[0]), after)
+	case len(common) > len(ctx.Word()):
+		insertCompletion(before, completions.Insertion(ctx, completions.Candidate{Text: common, NoSpace: true}), after)
+	default:
+		menu = completionMenu{
+			active:     true,
+			ctx:        ctx,
+			candidates: candidates,
+			selected:   -1,
+			before:     before,
+			after:      after,
+			original:   append([]rune(nil), line...),
+			pos:        pos,
+			columns:    1,
+		}
+		redrawLine()
+	}
+}
+
+// insertCompletion replaces the line with text between before and after,
+// leaving the cursor after text.
+func insertCompletion(before []rune, text string, after []rune) {
+	line := append(append(append([]rune(nil), before...), []rune(text)...), after...)
+	replaceLine(line, len(before)+len([]rune(text)))
+}
+
+// menuKey handles a key pressed while the menu is open, in the manner of
+// pickerKey. Tab, Shift-Tab and the arrow keys move through the menu,
+// Enter keeps the selected candidate and Ctrl-G or Ctrl-C puts the line
+// back. Any other key closes the menu and is then handled as usual.
+func menuKey(r rune) rune {
+	switch r {
+	case readline.CharEnter, readline.CharCtrlJ, readline.CharInterrupt:
+		lineEditor.Terminal.KickRead()
+	}
+
+	switch r {
+	case readline.CharTab, readline.CharForward:
+		selectCandidate(1)
+	case charBackTab, readline.CharBackward:
+		selectCandidate(-1)
+	case readline.CharNext:
+		selectCandidate(menu.columns)
+	case readline.CharPrev:
+		selectCandidate(-menu.columns)
+	case readline.CharEnter, readline.CharCtrlJ:
+		menu.active = false
+		redrawLine()
+	case readline.CharBell, readline.CharInterrupt:
+		menu.active = false
+		replaceLine(menu.original, menu.pos)
+	default:
+		menu.active = false
+		redrawLine()
+		return r
+	}
+	return readline.CharBell
+}
+
+// selectCandidate moves the selection by delta, wrapping around at either
+// end, and puts the candidate in the line.
+func selectCandidate(delta int) {
+	n := len(menu.candidates)
+	switch {
+	case menu.selected < 0 && delta > 0:
+		menu.selected = 0
+	case menu.selected < 0:
+		menu.selected = n - 1
+	default:
+		menu.selected = ((menu.selected+delta)%n + n) % n
+	}
+	insertCompletion(menu.before, completions.Insertion(menu.ctx, menu.candidates[menu.selected]), menu.after)
+}
+
+// menuSequence returns the escape sequence that draws the menu below line.
+// It is written where line starts, right after the prompt: it makes room
+// below the line, scrolling the screen if it has to, then draws the menu
+// and puts the cursor back for readline to draw the line.
+func menuSequence(line []rune) string {
+	width, height, err := readline.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+	rows := menuRows(width, height)
+
+	promptWidth := readline.Runes{}.WidthAll(readline.Runes{}.ColorFilter([]rune(currentPrompt)))
+	lineRows := (promptWidth + readline.Runes{}.WidthAll(line)) / width
+	below := lineRows + len(rows)
+
+	var sb strings.Builder
+	sb.WriteString(strings.Repeat("\n", below))
+	fmt.Fprintf(&sb, "\033[%dA\033[%dG\0337", below, promptWidth%width+1)
+	if lineRows > 0 {
+		fmt.Fprintf(&sb, "\033[%dB", lineRows)
+	}
+	for _, row := range rows {
+		sb.WriteString("\r\n\033[2K" + row)
+	}
+	sb.WriteString("\0338")
+	return sb.String()
+}
+
+// menuCell is a candidate laid out for the menu.
+type menuCell struct {
+	icon, color, name, description string
+}
+
+// menuRows lays the candidates out in as many columns as fit the screen
+// and returns the rows to show: at most half the screen, scrolled to keep
+// the selection in view, with a note below when some don't fit.
+func menuRows(width, height int) []string {
+	cells := make([]menuCell, len(menu.candidates))
+	nameWidth, descWidth := 0, 0
+	for i, candidate := range menu.candidates {
+		cell := menuCell{name: candidate.Text, description: candidate.Description}
+		if f := candidate.File; f != nil {
+			cell.name = f.Name
+			if f.IsDir {
+				cell.name += "/"
+			}
+			cell.icon = cmds.GetFileIcon(f.Name, f.IsDir, f.IsExecutable, f.IsSymlink) + " "
+			cell.color = cmds.FileColor(f.IsDir, f.IsExecutable, f.IsSymlink)
+		}
+		cells[i] = cell
+		nameWidth = max(nameWidth, len([]rune(cell.icon+cell.name)))
+		descWidth = max(descWidth, len([]rune(cell.description)))
+	}
+
+	// Leave the last column free so the terminal doesn't wrap, and drop
+	// descriptions rather than squeeze them
+	room := width - 1
+	nameWidth = min(nameWidth, room)
+	if left := room - nameWidth - 2; left < 4 {
+		descWidth = 0
+	} else {
+		descWidth = min(descWidth, 30, left)
+	}
+	cellWidth := nameWidth
+	if descWidth > 0 {
+		cellWidth += 2 + descWidth
+	}
+	columns := max((room+2)/(cellWidth+2), 1)
+	menu.columns = columns
+
+	total := (len(cells) + columns - 1) / columns
+	visible := min(total, max(height/2-1, 1))
+	first := 0
+	if menu.selected >= 0 {
+		first = max(menu.selected/columns-visible+1, 0)
+	}
+
+	var rows []string
+	for row := first; row < first+visible; row++ {
+		var sb strings.Builder
+		for column := 0; column < columns; column++ {
+			i := row*columns + column
+			if i >= len(cells) {
+				break
+			}
+			if column > 0 {
+				sb.WriteString("  ")
+			}
+			sb.WriteString(menuCellText(cells[i], i == menu.selected, nameWidth, descWidth))
+		}
+		rows = append(rows, sb.String())
+	}
+	if visible < total {
+		rows = append(rows, fmt.Sprintf("\033[2mrows %d-%d of %d\033[22m", first+1, first+visible, total))
+	}
+	return rows
+}
+
+// menuCellText formats a cell, padded to the width of the menu's columns:
+// the icon and name in the file's color, then the description dimmed.
+func menuCellText(cell menuCell, selected bool, nameWidth, descWidth int) string {
+	var sb strings.Builder
+	if selected {
+		sb.WriteString("\033[7m")
+	}
+	name := truncate(cell.icon+cell.name, nameWidth)
+	sb.WriteString(cell.color + name + "\033[39m")
+	sb.WriteString(strings.Repeat(" ", nameWidth-len([]rune(name))))
+	if descWidth > 0 {
+		description := truncate(cell.description, descWidth)
+		sb.WriteString("  \033[2m" + description + "\033[22m")
+		sb.WriteString(strings.Repeat(" ", descWidth-len([]rune(description))))
+	}
+	if selected {
+		sb.WriteString("\033[27m")
+	}
+	return sb.String()
+}
@@ -0,0 +1,226 @@
+package parser
+
+import "strings"
+
+// List is a sequence of and-or lists separated by ';', '&' or newlines.
+type List struct {
+	Items []*AndOr
+}
+
+// AndOr is a chain of pipelines joined by && or ||.
+type AndOr struct {
+	Pipelines []*Pipeline
+	// Ops[i] is the operator between Pipelines[i] and Pipelines[i+1].
+	Ops []string
+	// Background is set when the list was terminated by &.
+	Background bool
+	// Source is the text of the list as it was typed.
+	Source string
+}
+
+// Pipeline is one or more commands joined by |.
+type Pipeline struct {
+	Cmds []Command
+	// Negated is set when the pipeline starts with !, inverting its status.
+	Negated bool
+	// Source is the text of the pipeline as it was typed.
+	Source string
+}
+
+// Command is a single stage of a pipeline.
+type Command interface {
+	command()
+}
+
+// SimpleCommand is a command name followed by its arguments and any
+// redirections. Assignments before the command name apply to that command
+// only, or to the shell when there is no command.
+type SimpleCommand struct {
+	Assigns []*Assign
+	Args    []*Word
+	Redirs  []*Redirect
+}
+
+// Assign is a variable assignment such as FOO=bar.
+type Assign struct {
+	Name  string
+	Value *Word
+}
+
+// Redirect is an I/O redirection such as "> out.log" or "2>&1".
+type Redirect struct {
+	// Fd is the file descriptor being redirected. It defaults to 0 for
+	// input operators and 1 for output operators.
+	Fd int
+	// Op is one of "<", ">", ">>", "<&", ">&", "&>" or "&>>". ">|" is
+	// normalised to ">".
+	Op string
+	// Target is the file name, or the descriptor number for "<&" and ">&".
+	Target *Word
+}
+
+// IfClause is an if statement. An elif is parsed as an Else list holding
+// a single IfClause.
+type IfClause struct {
+	Cond, Then *List
+	// Else is the else branch, or nil.
+	Else   *List
+	Redirs []*Redirect
+}
+
+// WhileClause is a while loop, or an until loop when Until is set.
+type WhileClause struct {
+	Cond, Body *List
+	Until      bool
+	Redirs     []*Redirect
+}
+
+// ForClause is a for loop over a list of words.
+type ForClause struct {
+	Name string
+	// Words are the words after "in". When there is no "in" the loop runs
+	// over the positional parameters, and HasIn is false.
+	Words  []*Word
+	HasIn  bool
+	Body   *List
+	Redirs []*Redirect
+}
+
+// CaseClause is a case statement.
+type CaseClause struct {
+	Word   *Word
+	Items  []*CaseItem
+	Redirs []*Redirect
+}
+
+// CaseItem is one pattern list of a case statement and the commands run
+// when it matches.
+type CaseItem struct {
+	Patterns []*Word
+	Body     *List
+}
+
+// Block is a group of commands in braces, { list; }.
+type Block struct {
+	Body   *List
+	Redirs []*Redirect
+}
+
+// FuncDecl defines a shell function, as name() body or function name body.
+type FuncDecl struct {
+	Name string
+	Body Command
+	// Source is the text of the definition as it was typed, with any
+	// aliases in it already expanded.
+	Source string
+}
+
+func (*SimpleCommand) command() {}
+func (*IfClause) command()      {}
+func (*WhileClause) command()   {}
+func (*ForClause) command()     {}
+func (*CaseClause) command()    {}
+func (*Block) command()         {}
+func (*FuncDecl) command()      {}
+
+// Word is a single shell word, made up of literal and quoted parts.
+type Word struct {
+	Parts []WordPart
+}
+
+// WordPart is a piece of a word.
+type WordPart interface {
+	wordPart()
+}
+
+// Lit is unquoted literal text.
+type Lit struct {
+	Value string
+}
+
+// SglQuoted is text inside single quotes, or a character escaped with a
+// backslash. Its value is never expanded.
+type SglQuoted struct {
+	Value string
+}
+
+// DblQuoted is text inside double quotes.
+type DblQuoted struct {
+	Parts []WordPart
+}
+
+// ParamExp is a parameter expansion such as $HOME, ${HOME} or
+// ${HOME:-/root}.
+type ParamExp struct {
+	Name string
+	// Short is set for the unbraced form, e.g. $HOME.
+	Short bool
+	// Length is set for ${#NAME}.
+	Length bool
+	// Op is the operator of ${NAME<op>word}: one of "-", "=", "+", "?",
+	// optionally preceded by ':', or "#", "##", "%", "%%". It is empty for
+	// a plain expansion.
+	Op  string
+	Arg *Word
+}
+
+// CmdSubst is a command substitution, $(list) or `list`, replaced by the
+// output of the commands.
+type CmdSubst struct {
+	List *List
+	// Backquote is set for the `list` form.
+	Backquote bool
+	// Source is the text of the commands as written.
+	Source string
+}
+
+func (*Lit) wordPart()       {}
+func (*SglQuoted) wordPart() {}
+func (*DblQuoted) wordPart() {}
+func (*ParamExp) wordPart()  {}
+func (*CmdSubst) wordPart()  {}
+
+// Lit returns the word with all quoting removed and expansions left as
+// written.
+func (w *Word) Lit() string {
+	var sb strings.Builder
+	writeParts(&sb, w.Parts)
+	return sb.String()
+}
+
+func writeParts(sb *strings.Builder, parts []WordPart) {
+	for _, part := range parts {
+		switch p := part.(type) {
+		case *Lit:
+			sb.WriteString(p.Value)
+		case *SglQuoted:
+			sb.WriteString(p.Value)
+		case *DblQuoted:
+			writeParts(sb, p.Parts)
+		case *ParamExp:
+			writeParam(sb, p)
+		case *CmdSubst:
+			if p.Backquote {
+				sb.WriteString("`" + p.Source + "`")
+			} else {
+				sb.WriteString("$(" + p.Source + ")")
+			}
+		}
+	}
+}
+
+func writeParam(sb *strings.Builder, p *ParamExp) {
+	if p.Short {
+		sb.WriteString("$" + p.Name)
+		return
+	}
+	sb.WriteString("${")
+	if p.Length {
+		sb.WriteString("#")
+	}
+	sb.WriteString(p.Name + p.Op)
+	if p.Arg != nil {
+		writeParts(sb, p.Arg.Parts)
+	}
+	sb.WriteString("}")
+}
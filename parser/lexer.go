@@ -0,0 +1,470 @@
+package parser
+
+import "strings"
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokOp
+	tokNewline
+	tokRedirect
+)
+
+type token struct {
+	kind tokenKind
+	op   string
+	word *Word
+	// fd is the explicit file descriptor of a redirection, or -1.
+	fd int
+	// pos is the offset of the token in the input.
+	pos int
+}
+
+// operators lists every control operator, longest first so that "&&"
+// wins over "&".
+var operators = []string{"&&", "||", ";;", "|", "&", ";", "(", ")"}
+
+// redirOperators lists every redirection operator, longest first.
+var redirOperators = []string{"&>>", "&>", ">>", ">&", ">|", "<&", ">", "<"}
+
+// isMeta reports whether r ends an unquoted word.
+func isMeta(r rune) bool {
+	return strings.ContainsRune(" \t\n|&;()<>", r)
+}
+
+// isSpecialParam reports whether r names a special parameter such as $?
+// or $#.
+func isSpecialParam(r rune) bool {
+	return strings.ContainsRune("?!$#@*", r)
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// lexer turns the input into tokens one at a time.
+type lexer struct {
+	src []rune
+	pos int
+	// aliases looks up alias text, or is nil when aliases aren't expanded.
+	aliases AliasFunc
+	// expanding holds the aliases whose text is being read.
+	expanding []aliasRegion
+}
+
+// aliasRegion is the span of input that came from expanding an alias.
+type aliasRegion struct {
+	name string
+	end  int
+}
+
+func (l *lexer) peekRune(off int) rune {
+	if l.pos+off >= len(l.src) {
+		return 0
+	}
+	return l.src[l.pos+off]
+}
+
+func (l *lexer) hasPrefix(s string) bool {
+	i := l.pos
+	for _, r := range s {
+		if i >= len(l.src) || l.src[i] != r {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// skipBlanks skips spaces, tabs, line continuations and comments.
+func (l *lexer) skipBlanks() {
+	for l.pos < len(l.src) {
+		switch r := l.src[l.pos]; {
+		case r == ' ' || r == '\t':
+			l.pos++
+		case r == '\\' && l.peekRune(1) == '\n':
+			l.pos += 2
+		case r == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// next returns the next token in the input.
+func (l *lexer) next() (token, error) {
+	l.skipBlanks()
+	// Remember where the token starts, since lexing a command
+	// substitution runs a nested parser over the same lexer
+	start := l.pos
+	tok, err := l.lexToken()
+	tok.pos = start
+	return tok, err
+}
+
+func (l *lexer) lexToken() (token, error) {
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF}, nil
+	}
+
+	if l.src[l.pos] == '\n' {
+		l.pos++
+		return token{kind: tokNewline, op: "\n"}, nil
+	}
+
+	if tok, ok := l.lexRedirect(); ok {
+		return tok, nil
+	}
+
+	for _, op := range operators {
+		if l.hasPrefix(op) {
+			l.pos += len(op)
+			return token{kind: tokOp, op: op}, nil
+		}
+	}
+
+	word, err := l.lexWord()
+	if err != nil {
+		return token{}, err
+	}
+	return token{kind: tokWord, word: word}, nil
+}
+
+// lexRedirect reads a redirection operator, including an optional leading
+// file descriptor number such as the 2 in "2>&1".
+func (l *lexer) lexRedirect() (token, bool) {
+	start := l.pos
+	fd := -1
+	end := l.pos
+	for end < len(l.src) && l.src[end] >= '0' && l.src[end] <= '9' {
+		end++
+	}
+	if end > start && end < len(l.src) && (l.src[end] == '<' || l.src[end] == '>') {
+		n := 0
+		for _, r := range l.src[start:end] {
+			n = n*10 + int(r-'0')
+		}
+		fd = n
+		l.pos = end
+	}
+
+	for _, op := range redirOperators {
+		if fd >= 0 && op[0] == '&' {
+			continue
+		}
+		if l.hasPrefix(op) {
+			l.pos += len(op)
+			return token{kind: tokRedirect, op: op, fd: fd}, true
+		}
+	}
+
+	l.pos = start
+	return token{}, false
+}
+
+// lexWord reads a word up to the next unquoted metacharacter.
+func (l *lexer) lexWord() (*Word, error) {
+	return l.lexWordUntil(isMeta)
+}
+
+// lexWordUntil reads a word up to the first unquoted rune for which stop
+// returns true.
+func (l *lexer) lexWordUntil(stop func(rune) bool) (*Word, error) {
+	word := &Word{}
+	var lit strings.Builder
+
+	flush := func() {
+		if lit.Len() > 0 {
+			word.Parts = append(word.Parts, &Lit{Value: lit.String()})
+			lit.Reset()
+		}
+	}
+
+	for l.pos < len(l.src) {
+		r := l.src[l.pos]
+		switch {
+		case stop(r):
+			flush()
+			return word, nil
+		case r == '\\':
+			if l.pos+1 >= len(l.src) {
+				return nil, &SyntaxError{Msg: "unexpected end of input after \\", Incomplete: true}
+			}
+			if l.src[l.pos+1] == '\n' {
+				// Line continuation
+				l.pos += 2
+				continue
+			}
+			flush()
+			word.Parts = append(word.Parts, &SglQuoted{Value: string(l.src[l.pos+1])})
+			l.pos += 2
+		case r == '\'':
+			flush()
+			end := l.pos + 1
+			for end < len(l.src) && l.src[end] != '\'' {
+				end++
+			}
+			if end >= len(l.src) {
+				return nil, &SyntaxError{Msg: "unterminated single quote", Incomplete: true}
+			}
+			word.Parts = append(word.Parts, &SglQuoted{Value: string(l.src[l.pos+1 : end])})
+			l.pos = end + 1
+		case r == '"':
+			flush()
+			part, err := l.lexDblQuoted()
+			if err != nil {
+				return nil, err
+			}
+			word.Parts = append(word.Parts, part)
+		case r == '$' && l.peekRune(1) == '(':
+			flush()
+			part, err := l.lexCmdSubst()
+			if err != nil {
+				return nil, err
+			}
+			word.Parts = append(word.Parts, part)
+		case r == '`':
+			flush()
+			part, err := l.lexBackquote()
+			if err != nil {
+				return nil, err
+			}
+			word.Parts = append(word.Parts, part)
+		case r == '$':
+			part, err := l.lexParam()
+			if err != nil {
+				return nil, err
+			}
+			if part == nil {
+				// A lone $ is literal
+				lit.WriteRune(r)
+				l.pos++
+				continue
+			}
+			flush()
+			word.Parts = append(word.Parts, part)
+		default:
+			lit.WriteRune(r)
+			l.pos++
+		}
+	}
+
+	flush()
+	return word, nil
+}
+
+// lexDblQuoted reads a double-quoted string, starting at the opening quote.
+func (l *lexer) lexDblQuoted() (*DblQuoted, error) {
+	l.pos++ // opening quote
+	quoted := &DblQuoted{}
+	var sb strings.Builder
+
+	flush := func() {
+		if sb.Len() > 0 {
+			quoted.Parts = append(quoted.Parts, &Lit{Value: sb.String()})
+			sb.Reset()
+		}
+	}
+
+	for l.pos < len(l.src) {
+		r := l.src[l.pos]
+		switch {
+		case r == '"':
+			l.pos++
+			flush()
+			return quoted, nil
+		case r == '$' && l.peekRune(1) == '(':
+			flush()
+			part, err := l.lexCmdSubst()
+			if err != nil {
+				return nil, err
+			}
+			quoted.Parts = append(quoted.Parts, part)
+		case r == '`':
+			flush()
+			part, err := l.lexBackquote()
+			if err != nil {
+				return nil, err
+			}
+			quoted.Parts = append(quoted.Parts, part)
+		case r == '$':
+			part, err := l.lexParam()
+			if err != nil {
+				return nil, err
+			}
+			if part == nil {
+				sb.WriteRune(r)
+				l.pos++
+				continue
+			}
+			flush()
+			quoted.Parts = append(quoted.Parts, part)
+		case r == '\\' && l.pos+1 < len(l.src):
+			// Inside double quotes a backslash only escapes these characters
+			switch next := l.src[l.pos+1]; next {
+			case '\n':
+			case '$', '`', '"', '\\':
+				sb.WriteRune(next)
+			default:
+				sb.WriteRune(r)
+				sb.WriteRune(next)
+			}
+			l.pos += 2
+		default:
+			sb.WriteRune(r)
+			l.pos++
+		}
+	}
+	return nil, &SyntaxError{Msg: "unterminated double quote", Incomplete: true}
+}
+
+// paramOperators lists the operators allowed in ${NAME<op>word}, longest
+// first.
+var paramOperators = []string{":-", ":=", ":+", ":?", "##", "%%", "-", "=", "+", "?", "#", "%"}
+
+// isNameStart reports whether r can start a variable name.
+func isNameStart(r rune) bool {
+	return r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+// isNameRune reports whether r can appear in a variable name.
+func isNameRune(r rune) bool {
+	return isNameStart(r) || r >= '0' && r <= '9'
+}
+
+// lexName reads a variable name, a special parameter or a positional
+// parameter, returning "" if there is none at the current position. Only
+// braced positional parameters such as ${10} may have several digits.
+func (l *lexer) lexName(braced bool) string {
+	if l.pos >= len(l.src) {
+		return ""
+	}
+	if r := l.src[l.pos]; isSpecialParam(r) {
+		l.pos++
+		return string(r)
+	}
+	start := l.pos
+	if isDigit(l.src[l.pos]) {
+		l.pos++
+		for braced && l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		return string(l.src[start:l.pos])
+	}
+	if !isNameStart(l.src[l.pos]) {
+		return ""
+	}
+	for l.pos < len(l.src) && isNameRune(l.src[l.pos]) {
+		l.pos++
+	}
+	return string(l.src[start:l.pos])
+}
+
+// lexParam reads a parameter expansion starting at the '$'. It returns nil,
+// and consumes nothing, when the '$' does not start an expansion.
+func (l *lexer) lexParam() (*ParamExp, error) {
+	start := l.pos
+	l.pos++ // $
+
+	if l.peekRune(0) != '{' {
+		name := l.lexName(false)
+		if name == "" {
+			l.pos = start
+			return nil, nil
+		}
+		return &ParamExp{Name: name, Short: true}, nil
+	}
+
+	l.pos++ // {
+	param := &ParamExp{}
+	if l.peekRune(0) == '#' && l.peekRune(1) != '}' {
+		param.Length = true
+		l.pos++
+	}
+	if param.Name = l.lexName(true); param.Name == "" {
+		return nil, &SyntaxError{Msg: "bad substitution"}
+	}
+
+	if !param.Length {
+		for _, op := range paramOperators {
+			if l.hasPrefix(op) {
+				param.Op = op
+				l.pos += len(op)
+				break
+			}
+		}
+	}
+	if param.Op != "" {
+		arg, err := l.lexWordUntil(func(r rune) bool { return r == '}' })
+		if err != nil {
+			return nil, err
+		}
+		param.Arg = arg
+	}
+
+	if l.peekRune(0) != '}' {
+		if l.pos >= len(l.src) {
+			return nil, &SyntaxError{Msg: "unterminated ${", Incomplete: true}
+		}
+		return nil, &SyntaxError{Msg: "bad substitution"}
+	}
+	l.pos++
+	return param, nil
+}
+
+// lexCmdSubst reads a $(...) command substitution, starting at the '$'.
+// The commands inside are parsed by a nested parser sharing this lexer, so
+// quotes and parentheses nest naturally.
+func (l *lexer) lexCmdSubst() (*CmdSubst, error) {
+	start := l.pos
+	l.pos += 2 // $(
+
+	p := &parser{lex: l}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	list, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isOp(")") {
+		if p.tok.kind == tokEOF {
+			return nil, &SyntaxError{Msg: "unterminated $(", Incomplete: true}
+		}
+		return nil, p.unexpected()
+	}
+	return &CmdSubst{List: list, Source: string(l.src[start+2 : l.pos-1])}, nil
+}
+
+// lexBackquote reads a `...` command substitution. Inside the backquotes a
+// backslash only escapes $, ` and \, and the text left after removing
+// those escapes is parsed on its own.
+func (l *lexer) lexBackquote() (*CmdSubst, error) {
+	l.pos++ // opening backquote
+	var sb strings.Builder
+	for l.pos < len(l.src) {
+		r := l.src[l.pos]
+		switch {
+		case r == '`':
+			l.pos++
+			src := sb.String()
+			list, err := parse(src, l.aliases)
+			if err != nil {
+				return nil, err
+			}
+			return &CmdSubst{List: list, Backquote: true, Source: src}, nil
+		case r == '\\' && l.pos+1 < len(l.src) && strings.ContainsRune("$`\\", l.src[l.pos+1]):
+			sb.WriteRune(l.src[l.pos+1])
+			l.pos += 2
+		default:
+			sb.WriteRune(r)
+			l.pos++
+		}
+	}
+	return nil, &SyntaxError{Msg: "unterminated `", Incomplete: true}
+}
@@ -0,0 +1,697 @@
+// Package parser turns shell input into a syntax tree of lists, and-or
+// chains, pipelines, simple commands and compound commands such as if,
+// while, for, case and function definitions.
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SyntaxError describes input that could not be parsed.
+type SyntaxError struct {
+	Msg string
+	// Incomplete is set when the input ended too early, e.g. inside quotes
+	// or an if statement, so more lines could complete it.
+	Incomplete bool
+}
+
+func (e *SyntaxError) Error() string {
+	return "syntax error: " + e.Msg
+}
+
+type parser struct {
+	lex *lexer
+	tok token
+	// end is the offset just past the last consumed token.
+	end int
+}
+
+// AliasFunc returns the text an alias stands for, and whether name is an
+// alias at all.
+type AliasFunc func(name string) (string, bool)
+
+// Parse parses src into a List.
+func Parse(src string) (*List, error) {
+	return parse(src, nil)
+}
+
+// ParseWithAliases parses src like Parse, expanding aliases wherever a
+// command name may appear. The alias text is parsed as if it had been
+// typed, so quotes and operators in it keep their meaning.
+func ParseWithAliases(src string, aliases AliasFunc) (*List, error) {
+	return parse(src, aliases)
+}
+
+func parse(src string, aliases AliasFunc) (*List, error) {
+	p := &parser{lex: &lexer{src: []rune(src), aliases: aliases}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	list, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.unexpected()
+	}
+	return list, nil
+}
+
+func (p *parser) next() error {
+	p.end = p.lex.pos
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) isOp(op string) bool {
+	return p.tok.kind == tokOp && p.tok.op == op
+}
+
+func (p *parser) unexpected() error {
+	switch p.tok.kind {
+	case tokEOF:
+		return &SyntaxError{Msg: "unexpected end of input", Incomplete: true}
+	case tokNewline:
+		return &SyntaxError{Msg: "unexpected newline"}
+	case tokWord:
+		return &SyntaxError{Msg: fmt.Sprintf("unexpected word `%s'", p.tok.word.Lit())}
+	}
+	return &SyntaxError{Msg: fmt.Sprintf("unexpected token `%s'", p.tok.op)}
+}
+
+// skipNewlines skips any newline tokens, e.g. after a trailing && or |.
+func (p *parser) skipNewlines() error {
+	for p.tok.kind == tokNewline {
+		if err := p.next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// source returns the input text from offset start up to the last consumed
+// token.
+func (p *parser) source(start int) string {
+	return string(p.lex.src[start:p.end])
+}
+
+// keyword returns the current token if it is an unquoted word that could
+// be a reserved word, and "" otherwise. Reserved words are only special
+// where a command could start.
+func (p *parser) keyword() string {
+	if p.tok.kind != tokWord || len(p.tok.word.Parts) != 1 {
+		return ""
+	}
+	if lit, ok := p.tok.word.Parts[0].(*Lit); ok {
+		return lit.Value
+	}
+	return ""
+}
+
+// isTerminator reports whether the current token is a reserved word that
+// ends a list, such as fi or done.
+func (p *parser) isTerminator() bool {
+	switch p.keyword() {
+	case "then", "elif", "else", "fi", "do", "done", "esac", "}":
+		return true
+	}
+	return false
+}
+
+// expect consumes the reserved word kw, or fails.
+func (p *parser) expect(kw string) error {
+	if p.keyword() != kw {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+// expectOp consumes the operator op, or fails.
+func (p *parser) expectOp(op string) error {
+	if !p.isOp(op) {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+// parseList parses and-or lists separated by ';', '&' or newlines. It
+// stops at anything that can't start a command, including reserved words
+// such as fi that close a compound command.
+func (p *parser) parseList() (*List, error) {
+	list := &List{}
+	for {
+		if err := p.skipNewlines(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokWord && p.tok.kind != tokRedirect || p.isTerminator() {
+			return list, nil
+		}
+
+		item, err := p.parseAndOr()
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, item)
+
+		if p.isOp("&") {
+			item.Background = true
+		} else if !p.isOp(";") && p.tok.kind != tokNewline {
+			return list, nil
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseAndOr parses pipelines joined by && or ||.
+func (p *parser) parseAndOr() (*AndOr, error) {
+	andOr := &AndOr{}
+	start := p.tok.pos
+	for {
+		pipeline, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		andOr.Pipelines = append(andOr.Pipelines, pipeline)
+
+		if !p.isOp("&&") && !p.isOp("||") {
+			andOr.Source = p.source(start)
+			return andOr, nil
+		}
+		andOr.Ops = append(andOr.Ops, p.tok.op)
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.skipNewlines(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parsePipeline parses commands joined by |, optionally preceded by !.
+func (p *parser) parsePipeline() (*Pipeline, error) {
+	pipeline := &Pipeline{}
+	start := p.tok.pos
+	if p.keyword() == "!" {
+		pipeline.Negated = true
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		cmd, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		pipeline.Cmds = append(pipeline.Cmds, cmd)
+
+		if !p.isOp("|") {
+			pipeline.Source = p.source(start)
+			return pipeline, nil
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.skipNewlines(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseCommand parses a single pipeline stage.
+func (p *parser) parseCommand() (Command, error) {
+	if err := p.expandAliases(); err != nil {
+		return nil, err
+	}
+	switch p.keyword() {
+	case "if":
+		return p.parseIf()
+	case "while", "until":
+		return p.parseWhile()
+	case "for":
+		return p.parseFor()
+	case "case":
+		return p.parseCase()
+	case "{":
+		return p.parseBlock()
+	case "function":
+		return p.parseFunction()
+	}
+	return p.parseSimpleCommand()
+}
+
+// expandAliases replaces an alias in command position with its text and
+// re-reads the input from there. Aliases may refer to other aliases, but an
+// alias is never expanded inside its own text, which stops loops such as
+// alias ls='ls -F'.
+func (p *parser) expandAliases() error {
+	l := p.lex
+	for l.aliases != nil {
+		name := p.keyword()
+		if name == "" || l.isExpanding(name, p.tok.pos) {
+			return nil
+		}
+		text, ok := l.aliases(name)
+		if !ok {
+			return nil
+		}
+
+		// Splice the alias text into the input in place of the word
+		start, end := p.tok.pos, l.pos
+		replacement := []rune(text)
+		src := make([]rune, 0, len(l.src)-(end-start)+len(replacement))
+		src = append(src, l.src[:start]...)
+		src = append(src, replacement...)
+		l.src = append(src, l.src[end:]...)
+
+		delta := len(replacement) - (end - start)
+		for i := range l.expanding {
+			if l.expanding[i].end >= end {
+				l.expanding[i].end += delta
+			}
+		}
+		l.expanding = append(l.expanding, aliasRegion{name: name, end: start + len(replacement)})
+
+		l.pos = start
+		if err := p.next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isExpanding reports whether the input at pos comes from the text of the
+// alias name.
+func (l *lexer) isExpanding(name string, pos int) bool {
+	for _, region := range l.expanding {
+		if region.name == name && pos < region.end {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSimpleCommand parses assignments, words and redirections, or a
+// function definition of the form name() body.
+func (p *parser) parseSimpleCommand() (Command, error) {
+	cmd := &SimpleCommand{}
+	start := p.tok.pos
+	for {
+		switch p.tok.kind {
+		case tokWord:
+			if assign := parseAssign(p.tok.word); assign != nil && len(cmd.Args) == 0 {
+				cmd.Assigns = append(cmd.Assigns, assign)
+			} else {
+				cmd.Args = append(cmd.Args, p.tok.word)
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			continue
+		case tokRedirect:
+			redir, err := p.parseRedirect()
+			if err != nil {
+				return nil, err
+			}
+			cmd.Redirs = append(cmd.Redirs, redir)
+			continue
+		}
+		break
+	}
+	if len(cmd.Args) == 0 && len(cmd.Redirs) == 0 && len(cmd.Assigns) == 0 {
+		return nil, p.unexpected()
+	}
+
+	if p.isOp("(") && len(cmd.Args) == 1 && len(cmd.Redirs) == 0 && len(cmd.Assigns) == 0 {
+		name := cmd.Args[0].Lit()
+		if !IsName(name) {
+			return nil, &SyntaxError{Msg: fmt.Sprintf("`%s': not a valid function name", name)}
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		return p.parseFuncBody(name, start)
+	}
+	return cmd, nil
+}
+
+// parseRedirects parses any redirections after a compound command.
+func (p *parser) parseRedirects() ([]*Redirect, error) {
+	var redirs []*Redirect
+	for p.tok.kind == tokRedirect {
+		redir, err := p.parseRedirect()
+		if err != nil {
+			return nil, err
+		}
+		redirs = append(redirs, redir)
+	}
+	return redirs, nil
+}
+
+// parseCompoundList parses the list inside a compound command, which must
+// not be empty.
+func (p *parser) parseCompoundList() (*List, error) {
+	list, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) == 0 {
+		return nil, p.unexpected()
+	}
+	return list, nil
+}
+
+// parseIf parses if ... then ... [elif ... then ...] [else ...] fi.
+func (p *parser) parseIf() (*IfClause, error) {
+	clause, err := p.parseIfBody()
+	if err != nil {
+		return nil, err
+	}
+	clause.Redirs, err = p.parseRedirects()
+	return clause, err
+}
+
+// parseIfBody parses an if or elif up to and including the closing fi.
+func (p *parser) parseIfBody() (*IfClause, error) {
+	if err := p.next(); err != nil { // if or elif
+		return nil, err
+	}
+	clause := &IfClause{}
+	var err error
+	if clause.Cond, err = p.parseCompoundList(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("then"); err != nil {
+		return nil, err
+	}
+	if clause.Then, err = p.parseCompoundList(); err != nil {
+		return nil, err
+	}
+
+	switch p.keyword() {
+	case "elif":
+		elif, err := p.parseIfBody()
+		if err != nil {
+			return nil, err
+		}
+		clause.Else = &List{Items: []*AndOr{{Pipelines: []*Pipeline{{Cmds: []Command{elif}}}}}}
+		return clause, nil
+	case "else":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if clause.Else, err = p.parseCompoundList(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect("fi"); err != nil {
+		return nil, err
+	}
+	return clause, nil
+}
+
+// parseWhile parses while ... do ... done and until ... do ... done.
+func (p *parser) parseWhile() (*WhileClause, error) {
+	clause := &WhileClause{Until: p.keyword() == "until"}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var err error
+	if clause.Cond, err = p.parseCompoundList(); err != nil {
+		return nil, err
+	}
+	if clause.Body, err = p.parseDoGroup(); err != nil {
+		return nil, err
+	}
+	clause.Redirs, err = p.parseRedirects()
+	return clause, err
+}
+
+// parseDoGroup parses do ... done.
+func (p *parser) parseDoGroup() (*List, error) {
+	if err := p.expect("do"); err != nil {
+		return nil, err
+	}
+	body, err := p.parseCompoundList()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("done"); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// parseFor parses for NAME [in WORD ...]; do ... done.
+func (p *parser) parseFor() (*ForClause, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	clause := &ForClause{Name: p.keyword()}
+	if !IsName(clause.Name) {
+		if p.tok.kind == tokWord {
+			return nil, &SyntaxError{Msg: fmt.Sprintf("`%s': not a valid identifier", p.tok.word.Lit())}
+		}
+		return nil, p.unexpected()
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if err := p.skipNewlines(); err != nil {
+		return nil, err
+	}
+
+	if p.keyword() == "in" {
+		clause.HasIn = true
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for p.tok.kind == tokWord {
+			clause.Words = append(clause.Words, p.tok.word)
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if !p.isOp(";") && p.tok.kind != tokNewline {
+			return nil, p.unexpected()
+		}
+	}
+	if p.isOp(";") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.skipNewlines(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if clause.Body, err = p.parseDoGroup(); err != nil {
+		return nil, err
+	}
+	clause.Redirs, err = p.parseRedirects()
+	return clause, err
+}
+
+// parseCase parses case WORD in [(]PATTERN[|PATTERN]...) LIST ;; ... esac.
+func (p *parser) parseCase() (*CaseClause, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokWord {
+		return nil, p.unexpected()
+	}
+	clause := &CaseClause{Word: p.tok.word}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if err := p.skipNewlines(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("in"); err != nil {
+		return nil, err
+	}
+
+	for {
+		if err := p.skipNewlines(); err != nil {
+			return nil, err
+		}
+		if p.keyword() == "esac" {
+			break
+		}
+
+		item := &CaseItem{}
+		if p.isOp("(") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		for {
+			if p.tok.kind != tokWord {
+				return nil, p.unexpected()
+			}
+			item.Patterns = append(item.Patterns, p.tok.word)
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if !p.isOp("|") {
+				break
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if item.Body, err = p.parseList(); err != nil {
+			return nil, err
+		}
+		clause.Items = append(clause.Items, item)
+
+		if !p.isOp(";;") {
+			break
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expect("esac"); err != nil {
+		return nil, err
+	}
+	var err error
+	clause.Redirs, err = p.parseRedirects()
+	return clause, err
+}
+
+// parseBlock parses { list; }.
+func (p *parser) parseBlock() (*Block, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	block := &Block{}
+	var err error
+	if block.Body, err = p.parseCompoundList(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("}"); err != nil {
+		return nil, err
+	}
+	block.Redirs, err = p.parseRedirects()
+	return block, err
+}
+
+// parseFunction parses function NAME [()] body.
+func (p *parser) parseFunction() (*FuncDecl, error) {
+	start := p.tok.pos
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	name := p.keyword()
+	if !IsName(name) {
+		return nil, p.unexpected()
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.isOp("(") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+	}
+	return p.parseFuncBody(name, start)
+}
+
+// parseFuncBody parses the compound command that makes up a function body.
+// start is where the definition began.
+func (p *parser) parseFuncBody(name string, start int) (*FuncDecl, error) {
+	if err := p.skipNewlines(); err != nil {
+		return nil, err
+	}
+	body, err := p.parseCommand()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := body.(*SimpleCommand); ok {
+		return nil, &SyntaxError{Msg: fmt.Sprintf("function %s: body must be a compound command", name)}
+	}
+	return &FuncDecl{Name: name, Body: body, Source: p.source(start)}, nil
+}
+
+// parseRedirect parses a redirection operator and its target word.
+func (p *parser) parseRedirect() (*Redirect, error) {
+	redir := &Redirect{Fd: p.tok.fd, Op: p.tok.op}
+	if redir.Op == ">|" {
+		redir.Op = ">"
+	}
+	if redir.Fd < 0 {
+		redir.Fd = 1
+		if redir.Op[0] == '<' {
+			redir.Fd = 0
+		}
+	}
+
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokWord {
+		return nil, p.unexpected()
+	}
+	redir.Target = p.tok.word
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	return redir, nil
+}
+
+// parseAssign splits a word of the form NAME=value into an assignment. The
+// name and '=' must be unquoted. It returns nil for any other word.
+func parseAssign(word *Word) *Assign {
+	if len(word.Parts) == 0 {
+		return nil
+	}
+	lit, ok := word.Parts[0].(*Lit)
+	if !ok {
+		return nil
+	}
+	name, rest, found := strings.Cut(lit.Value, "=")
+	if !found || !IsName(name) {
+		return nil
+	}
+
+	value := &Word{}
+	if rest != "" {
+		value.Parts = append(value.Parts, &Lit{Value: rest})
+	}
+	value.Parts = append(value.Parts, word.Parts[1:]...)
+	return &Assign{Name: name, Value: value}
+}
+
+// IsName reports whether s is a valid variable name.
+func IsName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if i == 0 && !isNameStart(r) || !isNameRune(r) {
+			return false
+		}
+	}
+	return true
+}
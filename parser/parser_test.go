@@ -0,0 +1,291 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// dump renders a list compactly for comparison: simple commands in
+// brackets with their assignments, words and redirections, and compound
+// commands by their keywords.
+func dump(list *List) string {
+	var items []string
+	for _, andOr := range list.Items {
+		var sb strings.Builder
+		for i, pipeline := range andOr.Pipelines {
+			if i > 0 {
+				sb.WriteString(" " + andOr.Ops[i-1] + " ")
+			}
+			if pipeline.Negated {
+				sb.WriteString("! ")
+			}
+			for j, cmd := range pipeline.Cmds {
+				if j > 0 {
+					sb.WriteString(" | ")
+				}
+				sb.WriteString(dumpCommand(cmd))
+			}
+		}
+		if andOr.Background {
+			sb.WriteString(" &")
+		}
+		items = append(items, sb.String())
+	}
+	return strings.Join(items, "; ")
+}
+
+func dumpCommand(cmd Command) string {
+	switch c := cmd.(type) {
+	case *SimpleCommand:
+		var fields []string
+		for _, assign := range c.Assigns {
+			fields = append(fields, assign.Name+"="+assign.Value.Lit())
+		}
+		for _, arg := range c.Args {
+			fields = append(fields, arg.Lit())
+		}
+		for _, redir := range c.Redirs {
+			fields = append(fields, fmt.Sprintf("%d%s%s", redir.Fd, redir.Op, redir.Target.Lit()))
+		}
+		return "[" + strings.Join(fields, " ") + "]"
+	case *IfClause:
+		s := "if " + dump(c.Cond) + " then " + dump(c.Then)
+		if c.Else != nil {
+			s += " else " + dump(c.Else)
+		}
+		return s + " fi"
+	case *WhileClause:
+		keyword := "while"
+		if c.Until {
+			keyword = "until"
+		}
+		return keyword + " " + dump(c.Cond) + " do " + dump(c.Body) + " done"
+	case *ForClause:
+		var words []string
+		for _, word := range c.Words {
+			words = append(words, word.Lit())
+		}
+		if !c.HasIn {
+			return "for " + c.Name + " do " + dump(c.Body) + " done"
+		}
+		return "for " + c.Name + " in " + strings.Join(words, " ") + " do " + dump(c.Body) + " done"
+	case *CaseClause:
+		s := "case " + c.Word.Lit()
+		for _, item := range c.Items {
+			var patterns []string
+			for _, pattern := range item.Patterns {
+				patterns = append(patterns, pattern.Lit())
+			}
+			s += " " + strings.Join(patterns, "|") + ") " + dump(item.Body) + " ;;"
+		}
+		return s + " esac"
+	case *Block:
+		return "{ " + dump(c.Body) + " }"
+	case *FuncDecl:
+		return c.Name + "() " + dumpCommand(c.Body)
+	}
+	return fmt.Sprintf("%T", cmd)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"echo hello world", "[echo hello world]"},
+		{"  echo   spaced\t out  ", "[echo spaced out]"},
+		{"echo 'a b' \"c d\" e\\ f", "[echo a b c d e f]"},
+		{"echo a # a comment", "[echo a]"},
+		{"echo a#b", "[echo a#b]"},
+		{"a; b & c", "[a]; [b] &; [c]"},
+		{"a\nb\n\nc", "[a]; [b]; [c]"},
+		{"a && b || c", "[a] && [b] || [c]"},
+		{"a &&\n b", "[a] && [b]"},
+		{"a | b | c", "[a] | [b] | [c]"},
+		{"a |\n b", "[a] | [b]"},
+		{"! a | b", "! [a] | [b]"},
+		{"FOO=1 BAR=2 cmd x=y", "[FOO=1 BAR=2 cmd x=y]"},
+		{"FOO=1", "[FOO=1]"},
+		{"cmd > out 2>&1", "[cmd 1>out 2>&1]"},
+		{"cmd < in >> log 2> err", "[cmd 0<in 1>>log 2>err]"},
+		{"cmd >| out &> both", "[cmd 1>out 1&>both]"},
+		{"echo $HOME ${x:-y} $(pwd) `date`", "[echo $HOME ${x:-y} $(pwd) `date`]"},
+		{"echo \"$(echo \"in\")\"", "[echo $(echo \"in\")]"},
+		{"if a; then b; elif c; then d; else e; fi", "if [a] then [b] else if [c] then [d] else [e] fi fi"},
+		{"while a; do b; done", "while [a] do [b] done"},
+		{"until a\ndo\n b\ndone", "until [a] do [b] done"},
+		{"for i in 1 2 3; do echo $i; done", "for i in 1 2 3 do [echo $i] done"},
+		{"for i; do echo $i; done", "for i do [echo $i] done"},
+		{"case $x in a|b) one ;; *) two ;; esac", "case $x a|b) [one] ;; *) [two] ;; esac"},
+		{"{ a; b; } > out", "{ [a]; [b] }"},
+		{"f() { echo hi; }", "f() { [echo hi] }"},
+		{"function g { echo hi; }", "g() { [echo hi] }"},
+		{"echo if then", "[echo if then]"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		list, err := Parse(tt.src)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.src, err)
+			continue
+		}
+		if got := dump(list); got != tt.want {
+			t.Errorf("Parse(%q) = %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		src        string
+		incomplete bool
+	}{
+		{"echo 'unterminated", true},
+		{"echo \"unterminated", true},
+		{"echo $(pwd", true},
+		{"if true; then", true},
+		{"while true; do echo", true},
+		{"a &&", true},
+		{"a |", true},
+		{"echo a\\", true},
+		{"then", false},
+		{"a ;; b", false},
+		{"| a", false},
+		{"f() echo", false},
+		{"fi", false},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.src)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Parse(%q) error = %v, want a syntax error", tt.src, err)
+			continue
+		}
+		if syntaxErr.Incomplete != tt.incomplete {
+			t.Errorf("Parse(%q) Incomplete = %v, want %v (%v)", tt.src, syntaxErr.Incomplete, tt.incomplete, err)
+		}
+	}
+}
+
+func TestParseWithAliases(t *testing.T) {
+	aliases := map[string]string{
+		"ll":    "ls -l",
+		"ls":    "ls -F",
+		"quote": "echo 'a b'",
+		"both":  "a && b",
+		"loop":  "loop x",
+	}
+	lookup := func(name string) (string, bool) {
+		text, ok := aliases[name]
+		return text, ok
+	}
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"ll /tmp", "[ls -F -l /tmp]"},
+		{"ls", "[ls -F]"},
+		{"echo ll", "[echo ll]"},
+		{"quote c", "[echo a b c]"},
+		{"both || c", "[a] && [b] || [c]"},
+		{"x | ll", "[x] | [ls -F -l]"},
+		{"loop", "[loop x]"},
+		{"'ll'", "[ll]"},
+		{"if ll; then ll; fi", "if [ls -F -l] then [ls -F -l] fi"},
+	}
+	for _, tt := range tests {
+		list, err := ParseWithAliases(tt.src, lookup)
+		if err != nil {
+			t.Errorf("ParseWithAliases(%q): %v", tt.src, err)
+			continue
+		}
+		if got := dump(list); got != tt.want {
+			t.Errorf("ParseWithAliases(%q) = %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		src      string
+		andOr    string
+		pipeline string
+	}{
+		{"a | b && c; d", "a | b && c", "a | b"},
+		{"! x |  y &", "! x |  y", "! x |  y"},
+		{"for i in 1; do :; done | cat", "for i in 1; do :; done | cat", "for i in 1; do :; done | cat"},
+	}
+	for _, tt := range tests {
+		list, err := Parse(tt.src)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.src, err)
+			continue
+		}
+		andOr := list.Items[0]
+		if andOr.Source != tt.andOr {
+			t.Errorf("Parse(%q): and-or source = %q, want %q", tt.src, andOr.Source, tt.andOr)
+		}
+		if got := andOr.Pipelines[0].Source; got != tt.pipeline {
+			t.Errorf("Parse(%q): pipeline source = %q, want %q", tt.src, got, tt.pipeline)
+		}
+	}
+}
+
+func TestFuncDeclSource(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		if name == "greet" {
+			return "echo hello", true
+		}
+		return "", false
+	}
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"f() { echo hi; }", "f() { echo hi; }"},
+		{"f()\n{\n  echo hi\n} > out; echo after", "f()\n{\n  echo hi\n} > out"},
+		{"function g { greet; }", "function g { echo hello; }"},
+	}
+	for _, tt := range tests {
+		list, err := ParseWithAliases(tt.src, lookup)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.src, err)
+			continue
+		}
+		fn, ok := list.Items[0].Pipelines[0].Cmds[0].(*FuncDecl)
+		if !ok {
+			t.Errorf("Parse(%q) = %s, want a function", tt.src, dump(list))
+			continue
+		}
+		if fn.Source != tt.want {
+			t.Errorf("Parse(%q): Source = %q, want %q", tt.src, fn.Source, tt.want)
+		}
+		// The source parses back to the same function without aliases
+		again, err := Parse(fn.Source)
+		if err != nil || dump(again) != dumpCommand(fn) {
+			t.Errorf("Parse(%q) = %v, %v, want %s", fn.Source, again, err, dumpCommand(fn))
+		}
+	}
+}
+
+func TestIsName(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"x", true},
+		{"_x1", true},
+		{"PATH", true},
+		{"1x", false},
+		{"a-b", false},
+		{"", false},
+		{"a b", false},
+	}
+	for _, tt := range tests {
+		if got := IsName(tt.s); got != tt.want {
+			t.Errorf("IsName(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"formalshell/history"
+	"github.com/chzyer/readline"
+)
+
+// pickerPrompt is shown in place of the prompt while the history picker is
+// open.
+const pickerPrompt = "history> "
+
+// historyPicker is the full-screen Ctrl-R history search. It runs inside
+// readline on the alternate screen: the line being edited is the query,
+// pickerKey takes the keys that move through the list, and the list is
+// redrawn below the line after every key.
+type historyPicker struct {
+	active bool
+	// hereOnly limits the list to commands run in dir.
+	hereOnly bool
+	dir      string
+	selected int
+	matches  []history.Match
+	// opening is set until the first draw, which also has to draw the
+	// query line.
+	opening bool
+	// saved is the line that was being edited when the picker opened,
+	// put back if it is cancelled.
+	saved []rune
+}
+
+var picker historyPicker
+
+// openPicker switches to the alternate screen and starts a search, using
+// the line being edited as the query.
+func openPicker() {
+	picker = historyPicker{active: true, opening: true, saved: append([]rune(nil), lastLine...)}
+	picker.dir, _ = os.Getwd()
+	os.Stdout.WriteString("\033[?1049h\033[H\033[2J")
+	lineEditor.SetPrompt(pickerPrompt)
+}
+
+// closePicker leaves the alternate screen, replacing the edited line with
+// line.
+func closePicker(line []rune) {
+	picker.active = false
+	replaceLine(line, len(line))
+	os.Stdout.WriteString("\033[?1049l")
+	lineEditor.SetPrompt(currentPrompt)
+}
+
+// pickerKey handles a key pressed while the picker is open. Keys it uses
+// itself become a bell, which readline ignores; the rest edit the query.
+func pickerKey(r rune) rune {
+	// readline's terminal stops reading after these keys until the line
+	// is handed back, which doesn't happen here
+	switch r {
+	case readline.CharEnter, readline.CharCtrlJ, readline.CharInterrupt, readline.CharDelete:
+		lineEditor.Terminal.KickRead()
+	}
+
+	switch r {
+	case readline.CharPrev:
+		picker.selected = max(picker.selected-1, 0)
+	case readline.CharNext:
+		picker.selected = min(picker.selected+1, max(len(picker.matches)-1, 0))
+	case readline.CharBckSearch:
+		picker.hereOnly = !picker.hereOnly
+		picker.selected = 0
+	case readline.CharEnter, readline.CharCtrlJ, readline.CharTab:
+		if picker.selected < len(picker.matches) {
+			closePicker([]rune(picker.matches[picker.selected].Command))
+		} else {
+			closePicker(picker.saved)
+		}
+	case readline.CharBell, readline.CharInterrupt:
+		closePicker(picker.saved)
+	case readline.CharDelete, readline.CharFwdSearch, readline.CharCtrlZ:
+		// Ctrl-D would end the shell on an empty query
+	default:
+		return r
+	}
+	return readline.CharBell
+}
+
+// updatePicker searches the history for the query line and redraws the
+// list.
+func updatePicker(line []rune) {
+	dir := ""
+	if picker.hereOnly {
+		dir = picker.dir
+	}
+	picker.matches = shellHistory.Search(string(line), dir)
+	picker.selected = min(picker.selected, max(len(picker.matches)-1, 0))
+	if picker.opening {
+		picker.opening = false
+		lineEditor.Refresh()
+	}
+	drawPicker()
+}
+
+// drawPicker draws the list of matches below the query line, which stays
+// where readline put it.
+func drawPicker() {
+	width, height, err := readline.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\0337")
+
+	scope := "all directories"
+	if picker.hereOnly {
+		scope = "in " + shortenPath(picker.dir)
+	}
+	header := fmt.Sprintf("  %d/%d %s · Ctrl-R: this directory only · Enter: insert · Ctrl-G: cancel",
+		len(picker.matches), len(shellHistory.Entries), scope)
+	fmt.Fprintf(&sb, "\033[2;1H\033[2K\033[2m%s\033[0m", truncate(header, width))
+
+	// Scroll so the selected entry stays on screen
+	rows := max(height-2, 1)
+	first := max(picker.selected-rows+1, 0)
+	for row := 0; row < rows; row++ {
+		fmt.Fprintf(&sb, "\033[%d;1H\033[2K", row+3)
+		if i := first + row; i < len(picker.matches) {
+			sb.WriteString(pickerRow(picker.matches[i], i == picker.selected, width))
+		}
+	}
+
+	sb.WriteString("\0338")
+	os.Stdout.WriteString(sb.String())
+}
+
+// pickerRow formats one match: the command with its matching characters
+// highlighted, then its exit status and directory on the right.
+func pickerRow(m history.Match, selected bool, width int) string {
+	status := "\033[32m✓\033[39m"
+	statusLen := 1
+	if m.Status != 0 {
+		code := fmt.Sprint(m.Status)
+		status = "\033[31m✗ " + code + "\033[39m"
+		statusLen = 2 + len(code)
+	}
+	dir := shortenPath(m.Dir)
+	right := "  " + status + "  \033[2m" + dir + "\033[22m"
+	rightLen := 4 + statusLen + len([]rune(dir))
+
+	var sb strings.Builder
+	if selected {
+		sb.WriteString("\033[1;7m> ")
+	} else {
+		sb.WriteString("  ")
+	}
+
+	// Leave the last column free so the terminal doesn't wrap
+	room := width - 3 - rightLen
+	if room < 10 {
+		room, right, rightLen = width-3, "", 0
+	}
+	highlight := make(map[int]bool, len(m.Positions))
+	for _, p := range m.Positions {
+		highlight[p] = true
+	}
+	used := 0
+	for i, r := range []rune(m.Command) {
+		if used >= room {
+			break
+		}
+		if r == '\n' {
+			r = '↵'
+		}
+		if highlight[i] {
+			sb.WriteString("\033[33m" + string(r) + "\033[39m")
+		} else {
+			sb.WriteRune(r)
+		}
+		used++
+	}
+	sb.WriteString(strings.Repeat(" ", max(room-used, 0)))
+	sb.WriteString(right)
+	sb.WriteString("\033[0m")
+	return sb.String()
+}
+
+// shortenPath replaces the home directory at the start of path with ~.
+func shortenPath(path string) string {
+	if home, err := os.UserHomeDir(); err == nil && home != "" {
+		if path == home {
+			return "~"
+		}
+		if rest, ok := strings.CutPrefix(path, home+"/"); ok {
+			return "~/" + rest
+		}
+	}
+	return path
+}
+
+// truncate cuts s to at most width runes.
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) > width {
+		return string(runes[:max(width, 0)])
+	}
+	return s
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"formalshell/cmds"
+	"formalshell/expand"
+	"formalshell/parser"
+)
+
+// applyRedirects returns a copy of stdio with the given redirections applied
+// in order, along with a function that closes any files it opened. Targets
+// are expanded with env.
+func applyRedirects(env expand.Env, redirs []*parser.Redirect, stdio *cmds.IO) (*cmds.IO, func(), error) {
+	result := *stdio
+	var opened []*os.File
+	closeAll := func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}
+
+	for _, redir := range redirs {
+		target, err := expand.Literal(env, redir.Target)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+
+		// Duplicate an existing descriptor, e.g. 2>&1
+		if redir.Op == ">&" || redir.Op == "<&" {
+			fd, err := strconv.Atoi(target)
+			if err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("%s: ambiguous redirect", target)
+			}
+			stream, err := streamFor(&result, fd)
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			if err := setStream(&result, redir.Fd, stream); err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			continue
+		}
+
+		var flags int
+		switch redir.Op {
+		case "<":
+			flags = os.O_RDONLY
+		case ">", "&>":
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		case ">>", "&>>":
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+
+		f, err := os.OpenFile(target, flags, 0666)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		opened = append(opened, f)
+
+		// &> sends both stdout and stderr to the file
+		if redir.Op == "&>" || redir.Op == "&>>" {
+			result.Stdout = f
+			result.Stderr = f
+			continue
+		}
+		if err := setStream(&result, redir.Fd, f); err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+	}
+
+	return &result, closeAll, nil
+}
+
+// streamFor returns the stream currently bound to fd.
+func streamFor(stdio *cmds.IO, fd int) (any, error) {
+	switch fd {
+	case 0:
+		return stdio.Stdin, nil
+	case 1:
+		return stdio.Stdout, nil
+	case 2:
+		return stdio.Stderr, nil
+	}
+	return nil, fmt.Errorf("%d: bad file descriptor", fd)
+}
+
+// setStream binds stream to fd.
+func setStream(stdio *cmds.IO, fd int, stream any) error {
+	switch fd {
+	case 0:
+		if r, ok := stream.(io.Reader); ok {
+			stdio.Stdin = r
+			return nil
+		}
+	case 1:
+		if w, ok := stream.(io.Writer); ok {
+			stdio.Stdout = w
+			return nil
+		}
+	case 2:
+		if w, ok := stream.(io.Writer); ok {
+			stdio.Stderr = w
+			return nil
+		}
+	}
+	return fmt.Errorf("%d: bad file descriptor", fd)
+}
@@ -0,0 +1,123 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned by LookPath when a command is not in the path.
+var ErrNotFound = errors.New("command not found")
+
+// ErrNotExecutable is returned by LookPath when a command exists but
+// can't be run.
+var ErrNotExecutable = errors.New("permission denied")
+
+// LookPath finds the executable for name. Names containing a slash are used
+// as they are; anything else is searched for in the colon-separated path.
+func LookPath(name, path string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, checkExecutable(name)
+	}
+
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		candidate := filepath.Join(dir, name)
+		if err := checkExecutable(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// checkExecutable reports whether file is a regular file that can be run.
+func checkExecutable(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return ErrNotExecutable
+	}
+	return nil
+}
+
+// Environ returns the environment for child processes, with PATH set to
+// the shell's own path.
+func Environ(path string) []string {
+	return append(os.Environ(), "PATH="+path)
+}
+
+// Command returns an exec.Cmd that runs name directly, looked up in path.
+func Command(name string, args []string, path string) (*exec.Cmd, error) {
+	file, err := LookPath(name, path)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(file, args...)
+	cmd.Args[0] = name
+	cmd.Env = Environ(path)
+	return cmd, nil
+}
+
+// CompatCommand returns an exec.Cmd that runs the command through /bin/sh
+// after sourcing ~/.config/formalshell/config, which is how every command
+// used to be run. The temporary script removes itself once sh has read it,
+// so the command may safely outlive the caller.
+func CompatCommand(name string, args []string, path string) (*exec.Cmd, error) {
+	tmpFile, err := os.CreateTemp("", "formalsh_cmd_*.sh")
+	if err != nil {
+		return nil, err
+	}
+
+	script := fmt.Sprintf("rm -f %s\n. ~/.config/formalshell/config\n%s",
+		Quote(tmpFile.Name()), quoteArgs(name, args))
+	if _, err := tmpFile.WriteString(script); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, err
+	}
+	tmpFile.Close()
+
+	cmd := exec.Command("/bin/sh", tmpFile.Name())
+	cmd.Env = Environ(path)
+	return cmd, nil
+}
+
+// quoteArgs builds a /bin/sh command line from already split words,
+// quoting anything sh would otherwise re-interpret.
+func quoteArgs(command string, args []string) string {
+	quoted := []string{Quote(command)}
+	for _, arg := range args {
+		quoted = append(quoted, Quote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Quote single-quotes s unless it only contains safe characters.
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=+,@%", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -1,168 +1,101 @@
 package shell
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
-	"syscall"
 )
 
-// ExecuteCommand runs an external command.
-func ExecuteCommand(command string, args []string, customPath string) {
-	// Set up signal handling
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT)
-	defer signal.Stop(sigChan)
+// DefaultLoginFiles are the files sourced for the login environment when
+// FORMALSHELL_LOGIN_FILES is not set.
+var DefaultLoginFiles = []string{"/etc/profile", "~/.zshenv"}
 
-	// Create a shell script that will execute the command
-	script := fmt.Sprintf(". ~/.config/formalshell/config\n%s %s", command, strings.Join(args, " "))
-	
-	tmpFile, err := os.CreateTemp("", "formalsh_cmd_*.sh")
-	if err != nil {
-		fmt.Printf("Error creating temp file: %v\n", err)
-		return
-	}
-	defer os.Remove(tmpFile.Name())
-
-	if _, err := tmpFile.WriteString(script); err != nil {
-		fmt.Printf("Error writing temp file: %v\n", err)
-		return
-	}
-	tmpFile.Close()
+// ignoredEnv are variables sh sets for itself, which say nothing about the
+// login environment.
+var ignoredEnv = map[string]bool{"_": true, "SHLVL": true, "PWD": true, "OLDPWD": true}
 
-	// Execute the command in a shell context
-	cmd := exec.Command("/bin/sh", tmpFile.Name())
-	cmd.Env = append(os.Environ(), "PATH="+customPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
+// EnvChange is a variable set or changed by importing the login
+// environment. Old is empty and Added is set for a new variable.
+type EnvChange struct {
+	Name, Old, New string
+	Added          bool
+}
 
-	// Start command in background
-	if err := cmd.Start(); err != nil {
-		fmt.Printf("%s: command not found\n", command)
-		return
+// LoginFiles returns the files to source for the login environment: the
+// colon-separated list in FORMALSHELL_LOGIN_FILES, or DefaultLoginFiles.
+// A leading ~/ is replaced by the home directory.
+func LoginFiles() []string {
+	files := DefaultLoginFiles
+	if list, ok := os.LookupEnv("FORMALSHELL_LOGIN_FILES"); ok {
+		files = filepath.SplitList(list)
 	}
 
-	// Handle command interruption
-	go func() {
-		select {
-		case <-sigChan:
-			if cmd.Process != nil {
-				cmd.Process.Signal(syscall.SIGINT)
-			}
+	home, _ := os.UserHomeDir()
+	var expanded []string
+	for _, file := range files {
+		if file == "" {
+			continue
 		}
-	}()
-
-	// Wait for command completion
-	err = cmd.Wait()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			// Don't print status for interrupted commands
-			if exitErr.ExitCode() != int(syscall.SIGINT) {
-				fmt.Printf("Command exited with status %d\n", exitErr.ExitCode())
-			}
+		if rest, ok := strings.CutPrefix(file, "~/"); ok && home != "" {
+			file = filepath.Join(home, rest)
 		}
-		return
+		expanded = append(expanded, file)
 	}
+	return expanded
 }
 
-// HandlePipes splits a command by pipes (`|`) and sets up a pipeline.
-func HandlePipes(input string) {
-	commands := strings.Split(input, "|")
-	var prevCmd *exec.Cmd
-
-	for i, cmdStr := range commands {
-		cmdStr = strings.TrimSpace(cmdStr)
-		parts := strings.Fields(cmdStr)
-
-		if len(parts) == 0 {
-			continue
-		}
-
-		cmd := exec.Command(parts[0], parts[1:]...)
-
-		// Connect stdout of the previous command to stdin of the current one
-		if prevCmd != nil {
-			pipe, _ := prevCmd.StdoutPipe()
-			cmd.Stdin = pipe
-		} else {
-			cmd.Stdin = os.Stdin
-		}
-
-		// Set stdout to os.Stdout for the last command
-		if i == len(commands)-1 {
-			cmd.Stdout = os.Stdout
-		}
-
-		cmd.Stderr = os.Stderr
-
-		// Start the previous command before chaining
-		if prevCmd != nil {
-			_ = prevCmd.Start()
-		}
+// ImportEnv sources each of files that exists in /bin/sh and copies the
+// resulting environment into the process, returning what changed, sorted
+// by name. The environment is read back as NUL-separated `env -0` output
+// through a private temporary file, so values may contain newlines.
+func ImportEnv(files []string) ([]EnvChange, error) {
+	tmpFile, err := os.CreateTemp("", "formalsh_env_*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
 
-		prevCmd = cmd
+	// Whatever the login files print goes to the terminal; only fd 3 is
+	// captured
+	var script strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&script, "[ -r %s ] && . %s\n", Quote(file), Quote(file))
 	}
+	script.WriteString("exec env -0 >&3\n")
 
-	// Run the final command in the chain
-	if prevCmd != nil {
-		_ = prevCmd.Run()
+	cmd := exec.Command("/bin/sh", "-c", script.String())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{tmpFile}
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("sourcing login files: %w", err)
 	}
-}
 
-// LoadConfig loads shell configuration from various sources
-func LoadConfig() (string, error) {
-	homeDir, err := os.UserHomeDir()
+	data, err := os.ReadFile(tmpFile.Name())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	customPath := os.Getenv("PATH")
-
-	// First source system profile and zshenv to get basic PATH and env vars
-	script := `
-		. /etc/profile
-		[ -f ~/.zshenv ] && . ~/.zshenv
-		env > "$TMPDIR/formalsh_env"
-	`
-	tmpFile, err := os.CreateTemp("", "formalsh_*.sh")
-	if err == nil {
-		defer os.Remove(tmpFile.Name())
-		if _, err := tmpFile.WriteString(script); err == nil {
-			tmpFile.Close()
-			cmd := exec.Command("/bin/sh", tmpFile.Name())
-			cmd.Run()
-
-			// Read and apply environment
-			if envData, err := os.ReadFile(os.Getenv("TMPDIR") + "/formalsh_env"); err == nil {
-				envVars := strings.Split(string(envData), "\n")
-				for _, line := range envVars {
-					if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
-						os.Setenv(parts[0], parts[1])
-						if parts[0] == "PATH" {
-							customPath = parts[1]
-						}
-					}
-				}
-				os.Remove(os.Getenv("TMPDIR") + "/formalsh_env")
-			}
+	var changes []EnvChange
+	for _, entry := range bytes.Split(data, []byte{0}) {
+		name, value, ok := strings.Cut(string(entry), "=")
+		if !ok || name == "" || ignoredEnv[name] {
+			continue
 		}
-	}
-
-	// Then load our specific config
-	configPath := filepath.Join(homeDir, ".config", "formalshell", "config")
-	if _, err := os.Stat(configPath); err == nil {
-		cmd := exec.Command("/bin/sh", configPath)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Env = os.Environ()
-		if err := cmd.Run(); err != nil {
-			fmt.Printf("Error loading formalsh config: %v\n", err)
+		old, existed := os.LookupEnv(name)
+		if existed && old == value {
+			continue
+		}
+		if err := os.Setenv(name, value); err != nil {
+			continue
 		}
+		changes = append(changes, EnvChange{Name: name, Old: old, New: value, Added: !existed})
 	}
-
-	return customPath, nil
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes, nil
 }
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"formalshell/cmds"
+	"formalshell/jobs"
+	"formalshell/parser"
+	"formalshell/shell"
+	"formalshell/vars"
+)
+
+// subshellArg is the argument formalshell is run with to be a subshell,
+// reading what to run from subshellState on fd 3.
+const subshellArg = "--subshell"
+
+// subshellState is what a subshell is given of the shell that started it,
+// and the command to run: a builtin or function with its arguments already
+// expanded, all of the commands in Source when List is set, or else
+// command Stage of the pipeline in Source.
+type subshellState struct {
+	Vars map[string]*vars.Variable
+	// Functions holds the source of each function definition.
+	Functions  []string
+	Aliases    map[string]string
+	Options    map[string]bool
+	Positional []string
+	ScriptName string
+	Pid        int
+	Status     int
+	// History is set when the shell has a history, which the subshell
+	// reads from $HISTFILE if it needs it.
+	History bool
+
+	Args    []string
+	Assigns []string
+	Source  string
+	List    bool
+	Stage   int
+}
+
+// startSubshell starts a pipeline stage as part of job in a formalshell
+// child process, so that nothing it changes, the working directory
+// included, reaches the shell. It returns -1 once the process is started,
+// like startStage, or the status of a stage that could not be started.
+func (sh *shellState) startSubshell(job *jobs.Job, state *subshellState, stdio *cmds.IO) int {
+	state.Vars = make(map[string]*vars.Variable)
+	for _, name := range shellVars.Names() {
+		if v := shellVars.Lookup(name); v != nil {
+			state.Vars[name] = v
+		}
+	}
+	for _, fn := range sh.functions {
+		state.Functions = append(state.Functions, fn.Source)
+	}
+	state.Aliases = aliases
+	state.Options = options
+	state.Positional = sh.positional
+	state.ScriptName = scriptName
+	state.Pid = shellPid
+	state.Status = sh.lastStatus
+	state.History = shellHistory != nil
+	data, err := json.Marshal(state)
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "formalshell: %v\n", err)
+		return 1
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "formalshell: %v\n", err)
+		return 1
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "formalshell: %v\n", err)
+		return 1
+	}
+	defer r.Close()
+	cmd := exec.Command(exe, subshellArg)
+	cmd.Stdin = stdio.Stdin
+	cmd.Stdout = stdio.Stdout
+	cmd.Stderr = stdio.Stderr
+	cmd.ExtraFiles = []*os.File{r}
+	if err := job.Start(cmd); err != nil {
+		w.Close()
+		fmt.Fprintf(stdio.Stderr, "formalshell: %v\n", err)
+		return 126
+	}
+
+	// The state may not fit in the pipe, so write it as the subshell
+	// reads it
+	go func() {
+		w.Write(data)
+		w.Close()
+	}()
+	return -1
+}
+
+// runSubshell is the main function of a subshell: it takes on the state
+// the shell wrote to fd 3 and runs the stage it was given.
+func runSubshell() int {
+	state := &subshellState{}
+	f := os.NewFile(3, "state")
+	err := json.NewDecoder(f).Decode(state)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "formalshell: reading subshell state: %v\n", err)
+		return 1
+	}
+
+	customPath = os.Getenv("PATH")
+	initVars()
+	for _, name := range shellVars.Names() {
+		if _, ok := state.Vars[name]; !ok {
+			shellVars.Unset(name)
+		}
+	}
+	for name, v := range state.Vars {
+		shellVars.Set(name, v.Value)
+		if v.Exported {
+			shellVars.Export(name)
+		} else {
+			shellVars.Unexport(name)
+		}
+	}
+	jobs.Init(false)
+
+	sh := mainShell
+	for _, src := range state.Functions {
+		if fn, ok := parseStage(src, 0).(*parser.FuncDecl); ok {
+			sh.functions[fn.Name] = fn
+		}
+	}
+	aliases = state.Aliases
+	options = state.Options
+	sh.positional = state.Positional
+	scriptName = state.ScriptName
+	shellPid = state.Pid
+	sh.lastStatus = state.Status
+	historyInSubshell = state.History
+
+	status := sh.runStage(state)
+	if sh.pending.kind == jumpExit {
+		return sh.pending.status
+	}
+	return status
+}
+
+// runStage runs the stage a subshell was given.
+func (sh *shellState) runStage(state *subshellState) int {
+	stdio := cmds.StdIO()
+	if state.List {
+		list, err := parser.Parse(state.Source)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "formalshell: bad subshell command: %s\n", state.Source)
+			return 1
+		}
+		return sh.runList(list, stdio, fgJob)
+	}
+	if state.Args == nil {
+		stage := parseStage(state.Source, state.Stage)
+		if stage == nil {
+			fmt.Fprintf(os.Stderr, "formalshell: bad subshell command: %s\n", state.Source)
+			return 1
+		}
+		return sh.runCompound(stage, stdio, fgJob)
+	}
+	return withVars(state.Assigns, func() int {
+		if fn, ok := sh.functions[state.Args[0]]; ok {
+			return sh.callFunction(fn, state.Args[1:], stdio, fgJob)
+		}
+		if builtin, ok := builtins[state.Args[0]]; ok {
+			return builtin(sh, stdio, state.Args[1:])
+		}
+		return commandError(state.Args[0], shell.ErrNotFound, stdio)
+	})
+}
+
+// listSource returns the text of list, with its and-or lists on lines of
+// their own.
+func listSource(list *parser.List) string {
+	var sb strings.Builder
+	for _, andOr := range list.Items {
+		sb.WriteString(andOr.Source)
+		if andOr.Background {
+			sb.WriteString(" &")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// parseStage returns command i of the pipeline in src, or nil if src isn't
+// a single pipeline. Aliases in src were expanded when the shell read it,
+// so they aren't expanded again.
+func parseStage(src string, i int) parser.Command {
+	list, err := parser.Parse(src)
+	if err != nil || len(list.Items) != 1 || len(list.Items[0].Pipelines) != 1 {
+		return nil
+	}
+	if stages := list.Items[0].Pipelines[0].Cmds; i < len(stages) {
+		return stages[i]
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/chzyer/readline"
+)
+
+// autosuggestion is the rest of a command from the history that the line
+// being typed might become, shown in gray after the cursor as in fish.
+var autosuggestion struct {
+	// line is the line the suggestion was drawn for, and ghost the
+	// suggested text after it, empty when none is shown.
+	line  []rune
+	ghost []rune
+	// hidden is set by the keys that finish a line, so that a suggestion
+	// isn't left drawn after it once it has been entered.
+	hidden bool
+}
+
+// suggestionText returns the text that draws the suggestion for line after
+// it, when the cursor is at the end of the line, and moves the cursor back
+// so readline carries on as if it wasn't there.
+func suggestionText(line []rune, pos int) []rune {
+	ghost := suggestionFor(line, pos)
+	autosuggestion.line = append(autosuggestion.line[:0], line...)
+	autosuggestion.ghost = ghost
+	if len(ghost) == 0 {
+		return nil
+	}
+
+	// Only draw what fits on the cursor's row, as readline doesn't know
+	// the suggestion is there when it works out where lines wrap
+	width, _, err := readline.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	column := (readline.Runes{}.WidthAll(readline.Runes{}.ColorFilter([]rune(currentPrompt))) +
+		readline.Runes{}.WidthAll(line)) % width
+	room := width - column - 1
+	if column == 0 || room <= 0 {
+		return nil
+	}
+	drawn, used := ghost, readline.Runes{}.WidthAll(ghost)
+	for used > room {
+		drawn = drawn[:len(drawn)-1]
+		used = readline.Runes{}.WidthAll(drawn)
+	}
+	if used == 0 {
+		return nil
+	}
+	return []rune(fmt.Sprintf("\033[90m%s\033[0m\033[%dD", string(drawn), used))
+}
+
+// suggestionFor returns the text to suggest after line: the rest of the
+// most recent command starting with it, preferring commands run in the
+// working directory.
+func suggestionFor(line []rune, pos int) []rune {
+	if autosuggestion.hidden || picker.active || shellHistory == nil || pos != len(line) ||
+		strings.TrimSpace(string(line)) == "" || menu.active {
+		return nil
+	}
+	dir, _ := os.Getwd()
+	command, ok := shellHistory.Suggest(string(line), dir)
+	if !ok {
+		return nil
+	}
+	return []rune(command)[len(line):]
+}
+
+// suggestionKey handles the keys that accept a suggestion: Right or End
+// take all of it and Alt-F its next word. It reports whether it used the
+// key.
+func suggestionKey(r rune) bool {
+	ghost := autosuggestion.ghost
+	autosuggestion.hidden = r == readline.CharEnter || r == readline.CharCtrlJ || r == readline.CharInterrupt
+	if len(ghost) == 0 {
+		return false
+	}
+
+	n := 0
+	switch r {
+	case readline.CharForward, readline.CharLineEnd:
+		n = len(ghost)
+	case readline.MetaForward:
+		n = nextWordEnd(ghost)
+	default:
+		return false
+	}
+	line := append(append([]rune(nil), autosuggestion.line...), ghost[:n]...)
+	replaceLine(line, len(line))
+	return true
+}
+
+// nextWordEnd returns where the first word of s ends, after any leading
+// blanks. A slash ends a word too, and is kept with it, so that a path is
+// taken one directory at a time.
+func nextWordEnd(s []rune) int {
+	i := 0
+	for i < len(s) && unicode.IsSpace(s[i]) {
+		i++
+	}
+	for i < len(s) && !unicode.IsSpace(s[i]) {
+		i++
+		if s[i-1] == '/' {
+			break
+		}
+	}
+	return i
+}
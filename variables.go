@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"formalshell/cmds"
+	"formalshell/expand"
+	"formalshell/jobs"
+	"formalshell/parser"
+	"formalshell/vars"
+)
+
+// shellVars holds the shell's variables. It is seeded from the environment
+// once the config has been loaded.
+var shellVars = vars.New(os.Environ())
+
+// initVars reloads the variables from the environment and keeps customPath
+// in step with $PATH.
+func initVars() {
+	shellVars = vars.New(os.Environ())
+	shellVars.OnChange = func(name string) {
+		if name == "PATH" {
+			customPath, _ = shellVars.Get("PATH")
+		}
+	}
+}
+
+// scriptName is $0: the script being run, or the shell itself.
+var scriptName = "formalshell"
+
+// shellPid is $$: the process ID of the shell, which its subshells keep.
+var shellPid = os.Getpid()
+
+// shellEnv exposes the shell's variables and special parameters to the
+// expand package, and runs command substitutions.
+type shellEnv struct {
+	// sh is the state of the shell running the command being expanded.
+	sh *shellState
+	// mode is the job mode of the command being expanded.
+	mode jobMode
+}
+
+func (e shellEnv) Get(name string) (string, bool) {
+	positional := e.sh.positional
+	switch name {
+	case "?":
+		return strconv.Itoa(e.sh.lastStatus), true
+	case "!":
+		if jobs.LastPid == 0 {
+			return "", false
+		}
+		return strconv.Itoa(jobs.LastPid), true
+	case "$":
+		return strconv.Itoa(shellPid), true
+	case "0":
+		return scriptName, true
+	case "#":
+		return strconv.Itoa(len(positional)), true
+	case "@", "*":
+		return strings.Join(positional, " "), len(positional) > 0
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 1 || n > len(positional) {
+			return "", false
+		}
+		return positional[n-1], true
+	}
+	return shellVars.Get(name)
+}
+
+func (e shellEnv) Args() []string {
+	return e.sh.positional
+}
+
+func (shellEnv) Set(name, value string) {
+	shellVars.Set(name, value)
+}
+
+// Subst runs a command substitution in a subshell, so that nothing it
+// changes reaches the shell, and returns what it wrote to stdout.
+func (e shellEnv) Subst(list *parser.List) (string, error) {
+	var status int
+	src := listSource(list)
+	out, err := captureOutput(os.Stdin, func(stdio *cmds.IO) {
+		job := jobs.New(src, subMode(e.mode) != subJob, false)
+		status = e.sh.startSubshell(job, &subshellState{Source: src, List: true}, stdio)
+		if status < 0 {
+			status = job.Wait()
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	e.sh.substStatus = status
+	return out, nil
+}
+
+// captureOutput calls run with stdout going to a pipe and returns what it
+// wrote. Like a subshell, it leaves the working directory alone.
+func captureOutput(stdin io.Reader, run func(stdio *cmds.IO)) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+
+	// Read concurrently so a command writing a lot doesn't block on a full
+	// pipe
+	var out bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&out, r)
+		r.Close()
+		close(done)
+	}()
+
+	if wd, err := os.Getwd(); err == nil {
+		defer os.Chdir(wd)
+	}
+
+	run(&cmds.IO{Stdin: stdin, Stdout: w, Stderr: os.Stderr})
+	w.Close()
+	<-done
+	return out.String(), nil
+}
+
+// subMode returns the job mode for commands run on behalf of a command
+// in the given mode: a backgrounded command can't hand the terminal on.
+func subMode(mode jobMode) jobMode {
+	if mode == fgJob {
+		return fgJob
+	}
+	return subJob
+}
+
+// evalAssigns expands the values of assignments into NAME=value pairs.
+func evalAssigns(env expand.Env, assigns []*parser.Assign) ([]string, error) {
+	pairs := make([]string, 0, len(assigns))
+	for _, assign := range assigns {
+		value, err := expand.Assignment(env, assign.Value)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, assign.Name+"="+value)
+	}
+	return pairs, nil
+}
+
+// setVars assigns NAME=value pairs as shell variables.
+func setVars(pairs []string) {
+	for _, pair := range pairs {
+		name, value, _ := strings.Cut(pair, "=")
+		shellVars.Set(name, value)
+	}
+}
+
+// withVars runs fn with NAME=value pairs temporarily assigned, as for
+// `FOO=bar builtin`, and restores the previous values afterwards.
+func withVars(pairs []string, fn func() int) int {
+	saved := make([]*vars.Variable, len(pairs))
+	for i, pair := range pairs {
+		name, value, _ := strings.Cut(pair, "=")
+		saved[i] = shellVars.Lookup(name)
+		shellVars.Set(name, value)
+		shellVars.Export(name)
+	}
+
+	defer func() {
+		// Restore in reverse so repeated names end up as they started
+		for i := len(pairs) - 1; i >= 0; i-- {
+			name, _, _ := strings.Cut(pairs[i], "=")
+			restoreVar(name, saved[i])
+		}
+	}()
+	return fn()
+}
+
+// restoreVar puts back a variable saved with Lookup, unsetting it if prev
+// is nil.
+func restoreVar(name string, prev *vars.Variable) {
+	if prev == nil {
+		shellVars.Unset(name)
+		return
+	}
+	shellVars.Set(name, prev.Value)
+	if prev.Exported {
+		shellVars.Export(name)
+	} else {
+		shellVars.Unexport(name)
+	}
+}
@@ -0,0 +1,154 @@
+// Package vars holds the shell's variables. Exported variables are kept in
+// sync with the process environment, so child processes and Go code such as
+// os.UserHomeDir see the same values as the shell.
+package vars
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Variable is a single shell variable.
+type Variable struct {
+	Value    string
+	Exported bool
+}
+
+// Store holds shell variables. It is safe for concurrent use, since
+// background lists run in their own goroutines.
+type Store struct {
+	mu   sync.RWMutex
+	vars map[string]*Variable
+	// OnChange is called with the name of a variable after it is set,
+	// exported or unset.
+	OnChange func(name string)
+}
+
+// New returns a Store with every entry of environ as an exported variable.
+func New(environ []string) *Store {
+	s := &Store{vars: make(map[string]*Variable)}
+	for _, entry := range environ {
+		if name, value, ok := strings.Cut(entry, "="); ok && name != "" {
+			s.vars[name] = &Variable{Value: value, Exported: true}
+		}
+	}
+	return s
+}
+
+// Get returns the value of a variable and whether it is set.
+func (s *Store) Get(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if v, ok := s.vars[name]; ok {
+		return v.Value, true
+	}
+	return "", false
+}
+
+// Lookup returns a copy of the variable, or nil if it is not set.
+func (s *Store) Lookup(name string) *Variable {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if v, ok := s.vars[name]; ok {
+		copied := *v
+		return &copied
+	}
+	return nil
+}
+
+// Set assigns a value, keeping the variable's export flag.
+func (s *Store) Set(name, value string) {
+	defer s.changed(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.vars[name]
+	if !ok {
+		v = &Variable{}
+		s.vars[name] = v
+	}
+	v.Value = value
+	if v.Exported {
+		os.Setenv(name, value)
+	}
+}
+
+// Export marks a variable for export to child processes, creating it with
+// an empty value if it doesn't exist.
+func (s *Store) Export(name string) {
+	defer s.changed(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.vars[name]
+	if !ok {
+		v = &Variable{}
+		s.vars[name] = v
+	}
+	v.Exported = true
+	os.Setenv(name, v.Value)
+}
+
+// Unexport keeps a variable but stops exporting it.
+func (s *Store) Unexport(name string) {
+	defer s.changed(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.vars[name]; ok && v.Exported {
+		v.Exported = false
+		os.Unsetenv(name)
+	}
+}
+
+// Unset removes a variable.
+func (s *Store) Unset(name string) {
+	defer s.changed(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.vars[name]; ok {
+		if v.Exported {
+			os.Unsetenv(name)
+		}
+		delete(s.vars, name)
+	}
+}
+
+// Names returns the names of all variables, sorted.
+func (s *Store) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.names()
+}
+
+func (s *Store) names() []string {
+	names := make([]string, 0, len(s.vars))
+	for name := range s.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Environ returns the exported variables as NAME=value pairs, sorted.
+func (s *Store) Environ() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var env []string
+	for _, name := range s.names() {
+		if v := s.vars[name]; v.Exported {
+			env = append(env, name+"="+v.Value)
+		}
+	}
+	return env
+}
+
+func (s *Store) changed(name string) {
+	if s.OnChange != nil {
+		s.OnChange(name)
+	}
+}